@@ -0,0 +1,370 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var ErrNoSigningKey = errors.New("no active signing key")
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a single JWT signing key. A key signs new tokens between NotBefore
+// and RetireAt and keeps validating tokens until ExpiresAt, which should be
+// at least AccessTokenTTL after RetireAt. Zero times are unbounded.
+type Key struct {
+	ID        string
+	Method    jwt.SigningMethod
+	NotBefore time.Time
+	RetireAt  time.Time
+	ExpiresAt time.Time
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+func (k *Key) canSign(now time.Time) bool {
+	if k.signKey == nil {
+		return false
+	}
+	if !k.NotBefore.IsZero() && now.Before(k.NotBefore) {
+		return false
+	}
+	if !k.RetireAt.IsZero() && !now.Before(k.RetireAt) {
+		return false
+	}
+
+	return true
+}
+
+func (k *Key) canVerify(now time.Time) bool {
+	return k.ExpiresAt.IsZero() || now.Before(k.ExpiresAt)
+}
+
+// KeyConfig describes a key in the keyring file. File is a PEM private key
+// for RS256 and EdDSA, or a raw secret for HS256. Relative paths are resolved
+// against the keyring file's directory. PublicKeyFile may be given instead of
+// File for RS256/EdDSA keys that only verify tokens issued elsewhere.
+type KeyConfig struct {
+	ID            string    `json:"kid"`
+	Algorithm     string    `json:"alg"`
+	File          string    `json:"file,omitempty"`
+	PublicKeyFile string    `json:"publicKeyFile,omitempty"`
+	NotBefore     time.Time `json:"notBefore,omitempty"`
+	RetireAt      time.Time `json:"retireAt,omitempty"`
+	ExpiresAt     time.Time `json:"expiresAt,omitempty"`
+}
+
+type KeyringConfig struct {
+	Keys []KeyConfig `json:"keys"`
+}
+
+// Keyring holds every key that may sign or validate tokens. Keys are looked
+// up by the kid header, so several of them can be valid at the same time
+// while a rotation is in progress.
+type Keyring struct {
+	mu   sync.RWMutex
+	path string
+	keys map[string]*Key
+}
+
+func NewKeyring(keys ...*Key) *Keyring {
+	kr := &Keyring{keys: make(map[string]*Key)}
+	for _, key := range keys {
+		kr.keys[key.ID] = key
+	}
+
+	return kr
+}
+
+// NewEphemeralKeyring returns a keyring with a random HS256 key. Tokens
+// signed with it do not survive a restart.
+func NewEphemeralKeyring() (*Keyring, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	return NewKeyring(&Key{
+		ID:        "ephemeral-" + hex.EncodeToString(secret[:4]),
+		Method:    jwt.SigningMethodHS256,
+		signKey:   secret,
+		verifyKey: secret,
+	}), nil
+}
+
+// LoadKeyring reads a JSON keyring file, see KeyringConfig.
+func LoadKeyring(path string) (*Keyring, error) {
+	kr := &Keyring{path: path}
+	if err := kr.Reload(); err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
+
+// Reload re-reads the keyring file. New keys and changed schedules take
+// effect immediately; on error the current keys are kept.
+func (kr *Keyring) Reload() error {
+	if kr.path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(kr.path)
+	if err != nil {
+		return err
+	}
+
+	var config KeyringConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("keyring %s: %w", kr.path, err)
+	}
+
+	keys := make(map[string]*Key)
+	dir := filepath.Dir(kr.path)
+	for _, kc := range config.Keys {
+		if kc.ID == "" {
+			return fmt.Errorf("keyring %s: key without kid", kr.path)
+		}
+		if _, ok := keys[kc.ID]; ok {
+			return fmt.Errorf("keyring %s: duplicate kid %q", kr.path, kc.ID)
+		}
+
+		key, err := loadKey(dir, kc)
+		if err != nil {
+			return fmt.Errorf("keyring %s: key %q: %w", kr.path, kc.ID, err)
+		}
+		keys[kc.ID] = key
+	}
+
+	kr.mu.Lock()
+	kr.keys = keys
+	kr.mu.Unlock()
+
+	return nil
+}
+
+// ReloadEvery reloads the keyring file periodically so that keys scheduled
+// for rotation can be added without restarting the server.
+func (kr *Keyring) ReloadEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := kr.Reload(); err != nil {
+			log.Printf("Keyring reload error: %s", err)
+		}
+	}
+}
+
+// Add inserts or replaces a key.
+func (kr *Keyring) Add(key *Key) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	kr.keys[key.ID] = key
+}
+
+// Signing returns the newest key that is currently allowed to sign.
+func (kr *Keyring) Signing() (*Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	now := time.Now()
+	var current *Key
+	for _, key := range kr.keys {
+		if !key.canSign(now) {
+			continue
+		}
+		if current == nil || key.NotBefore.After(current.NotBefore) ||
+			(key.NotBefore.Equal(current.NotBefore) && key.ID > current.ID) {
+			current = key
+		}
+	}
+
+	if current == nil {
+		return nil, ErrNoSigningKey
+	}
+
+	return current, nil
+}
+
+// Verifying returns the key with the given kid if it may still validate
+// tokens.
+func (kr *Keyring) Verifying(kid string) (*Key, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key, ok := kr.keys[kid]
+	if !ok || !key.canVerify(time.Now()) {
+		return nil, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+// Public returns the keys that are still valid for verification, sorted by
+// kid. HMAC keys are secret and are never included.
+func (kr *Keyring) Public() []*Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	now := time.Now()
+	var result []*Key
+	for _, key := range kr.keys {
+		if !key.canVerify(now) {
+			continue
+		}
+		if _, ok := key.Method.(*jwt.SigningMethodHMAC); ok {
+			continue
+		}
+		result = append(result, key)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result
+}
+
+func loadKey(dir string, kc KeyConfig) (*Key, error) {
+	key := &Key{
+		ID:        kc.ID,
+		NotBefore: kc.NotBefore,
+		RetireAt:  kc.RetireAt,
+		ExpiresAt: kc.ExpiresAt,
+	}
+
+	switch kc.Algorithm {
+	case "HS256":
+		key.Method = jwt.SigningMethodHS256
+		secret, err := readKeyFile(dir, kc.File)
+		if err != nil {
+			return nil, err
+		}
+		secret = []byte(strings.TrimSpace(string(secret)))
+		if len(secret) < 32 {
+			return nil, errors.New("HS256 secret must be at least 32 bytes")
+		}
+		key.signKey = secret
+		key.verifyKey = secret
+
+	case "RS256":
+		key.Method = jwt.SigningMethodRS256
+		if kc.File != "" {
+			data, err := readKeyFile(dir, kc.File)
+			if err != nil {
+				return nil, err
+			}
+			private, err := jwt.ParseRSAPrivateKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = &private.PublicKey
+		} else {
+			data, err := readKeyFile(dir, kc.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			public, err := jwt.ParseRSAPublicKeyFromPEM(data)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	case "EdDSA":
+		key.Method = SigningMethodEdDSA
+		if kc.File != "" {
+			private, err := readEd25519PrivateKey(dir, kc.File)
+			if err != nil {
+				return nil, err
+			}
+			key.signKey = private
+			key.verifyKey = private.Public()
+		} else {
+			public, err := readEd25519PublicKey(dir, kc.PublicKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			key.verifyKey = public
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", kc.Algorithm)
+	}
+
+	return key, nil
+}
+
+func readKeyFile(dir, name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("key file is not set")
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(dir, name)
+	}
+
+	return ioutil.ReadFile(name)
+}
+
+func readEd25519PrivateKey(dir, name string) (ed25519.PrivateKey, error) {
+	data, err := readKeyFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key file is not PEM encoded")
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+
+	return private, nil
+}
+
+func readEd25519PublicKey(dir, name string) (ed25519.PublicKey, error) {
+	data, err := readKeyFile(dir, name)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key file is not PEM encoded")
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	public, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+
+	return public, nil
+}
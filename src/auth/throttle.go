@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttle counts failed attempts per key (an account or a client address)
+// and locks the key out once MaxFailures failures happen within Window.
+type Throttle struct {
+	MaxFailures int
+	Window      time.Duration
+	Lockout     time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*throttleEntry
+	lastPrune time.Time
+}
+
+type throttleEntry struct {
+	failures    int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+func NewThrottle(maxFailures int, window, lockout time.Duration) *Throttle {
+	return &Throttle{
+		MaxFailures: maxFailures,
+		Window:      window,
+		Lockout:     lockout,
+		entries:     make(map[string]*throttleEntry),
+		lastPrune:   time.Now(),
+	}
+}
+
+// Allow reports whether another attempt is permitted for key and, if not,
+// how long the caller has to wait.
+func (t *Throttle) Allow(key string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[key]
+	if !ok {
+		return true, 0
+	}
+
+	now := time.Now()
+	if now.Before(entry.lockedUntil) {
+		return false, entry.lockedUntil.Sub(now)
+	}
+
+	return true, 0
+}
+
+// Fail records a failed attempt for key.
+func (t *Throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	t.prune(now)
+
+	entry, ok := t.entries[key]
+	if !ok || now.Sub(entry.windowStart) > t.Window {
+		entry = &throttleEntry{windowStart: now}
+		t.entries[key] = entry
+	}
+
+	entry.failures++
+	if entry.failures >= t.MaxFailures {
+		entry.lockedUntil = now.Add(t.Lockout)
+		entry.failures = 0
+		entry.windowStart = now
+	}
+}
+
+// Reset forgets the failures of key after a successful attempt.
+func (t *Throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.entries, key)
+}
+
+func (t *Throttle) prune(now time.Time) {
+	if now.Sub(t.lastPrune) < t.Window {
+		return
+	}
+	t.lastPrune = now
+
+	for key, entry := range t.entries {
+		if now.Sub(entry.windowStart) > t.Window && now.After(entry.lockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -2,53 +2,108 @@ package auth
 
 import (
 	"errors"
+	"log"
 	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/dgrijalva/jwt-go"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-var mySigningKey = []byte("secret")
+// AccessTokenTTL is kept short, clients stay logged in by exchanging
+// refresh tokens, see the sessions package.
+const AccessTokenTTL = 15 * time.Minute
+
+var keyring *Keyring
+
+func init() {
+	kr, err := NewEphemeralKeyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring = kr
+}
+
+// SetKeyring replaces the keyring used to sign and verify tokens.
+func SetKeyring(kr *Keyring) {
+	keyring = kr
+}
 
 type Claims struct {
-	UserID string `json:"userId"`
+	UserID    string `json:"userId"`
+	SessionID string `json:"sid"`
 	jwt.StandardClaims
 }
-func CreateToken(userID primitive.ObjectID) (string, error) {
-	// create the token
 
-	expirationTime := time.Now().Add(48 * time.Hour)
+func CreateToken(userID primitive.ObjectID, sessionID primitive.ObjectID) (string, error) {
+	key, err := keyring.Signing()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	expirationTime := now.Add(AccessTokenTTL)
 	// Create the JWT claims, which includes the username and expiry time
 	claims := &Claims{
-		UserID: userID.Hex(),
+		UserID:    userID.Hex(),
+		SessionID: sessionID.Hex(),
 		StandardClaims: jwt.StandardClaims{
-			// In JWT, the expiry time is expressed as unix milliseconds
+			// In JWT, the expiry time is expressed as unix seconds
 			ExpiresAt: expirationTime.Unix(),
+			IssuedAt:  now.Unix(),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
 
 	//Sign and get the complete encoded token as string
-	return token.SignedString(mySigningKey)
+	return token.SignedString(key.signKey)
 }
 
 func CheckToken(tokenStr string) (primitive.ObjectID, error) {
+	claims, err := ParseToken(tokenStr)
+	if err != nil {
+		return primitive.ObjectID{}, err
+	}
+
+	return claims.User()
+}
+
+// ParseToken validates the token signature and expiry and returns its claims.
+// It does not check whether the session behind the token was revoked.
+func ParseToken(tokenStr string) (*Claims, error) {
 	claims := &Claims{}
 
 	tkn, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-		return mySigningKey, nil
+		kid, _ := token.Header["kid"].(string)
+		key, err := keyring.Verifying(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		// Never let the token pick the algorithm for a key.
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+
+		return key.verifyKey, nil
 	})
 
 	if err!=nil {
-		return primitive.ObjectID{}, err
+		return nil, err
 	}
 
 	if !tkn.Valid {
-		return primitive.ObjectID{}, errors.New("token not valid")
+		return nil, errors.New("token not valid")
 	}
-	spew.Dump(claims)
 
-	return primitive.ObjectIDFromHex(claims.UserID)
-}
\ No newline at end of file
+	return claims, nil
+}
+
+func (c *Claims) User() (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.UserID)
+}
+
+func (c *Claims) Session() (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.SessionID)
+}
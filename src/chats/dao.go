@@ -3,6 +3,7 @@ package chats
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
 	"go.mongodb.org/mongo-driver/bson"
@@ -17,6 +18,13 @@ const (
 	CollectionName = "chats"
 )
 
+var ErrNotFound = errors.New("chat not found")
+var ErrAlreadyPinned = errors.New("message is already pinned")
+var ErrNotPinned = errors.New("message is not pinned")
+var ErrTooManyPins = fmt.Errorf("a chat can have at most %d pinned messages", MaxPins)
+
+// MaxPins caps the number of pinned messages of a chat.
+const MaxPins = 20
 
 type DAO struct {
 	client *mongo.Client
@@ -69,6 +77,10 @@ func (dao *DAO) GetChatByID(ctx context.Context, chatID primitive.ObjectID) (*Ch
 		chats = append(chats, chat)
 	}
 
+	if len(chats) == 0 {
+		return nil, ErrNotFound
+	}
+
 	if len(chats) !=1 {
 		return nil, errors.New("len(chats) !=1")
 	}
@@ -107,6 +119,66 @@ func (dao *DAO) AddChat(ctx context.Context, chat *Chat) error {
 	return nil
 }
 
+// PinMessage adds the pin to the chat and returns the updated chat.
+func (dao *DAO) PinMessage(ctx context.Context, chatID primitive.ObjectID, pin *Pin) (*Chat, error) {
+	filter := bson.D{
+		{"_id", chatID},
+		{"pins.messageId", bson.D{{"$ne", pin.MessageID}}},
+		{fmt.Sprintf("pins.%d", MaxPins-1), bson.D{{"$exists", false}}},
+	}
+	update := bson.D{{"$push", bson.D{{"pins", pin}}}}
+
+	chat, err := dao.findOneAndUpdate(ctx, filter, update)
+	if err != ErrNotFound {
+		return chat, err
+	}
+
+	// Tell why the pin was refused.
+	chat, err = dao.GetChatByID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range chat.Pins {
+		if p.MessageID == pin.MessageID {
+			return nil, ErrAlreadyPinned
+		}
+	}
+
+	return nil, ErrTooManyPins
+}
+
+// UnpinMessage removes the pin of the message and returns the updated chat.
+func (dao *DAO) UnpinMessage(ctx context.Context, chatID, messageID primitive.ObjectID) (*Chat, error) {
+	filter := bson.D{
+		{"_id", chatID},
+		{"pins.messageId", messageID},
+	}
+	update := bson.D{{"$pull", bson.D{{"pins", bson.D{{"messageId", messageID}}}}}}
+
+	chat, err := dao.findOneAndUpdate(ctx, filter, update)
+	if err == ErrNotFound {
+		return nil, ErrNotPinned
+	}
+
+	return chat, err
+}
+
+func (dao *DAO) findOneAndUpdate(ctx context.Context, filter, update interface{}) (*Chat, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var chat *Chat
+	err := dao.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&chat)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return chat, nil
+}
+
 func (dao *DAO) Drop(ctx context.Context) error{
 	return dao.collection.Drop(ctx)
 }
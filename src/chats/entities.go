@@ -10,4 +10,34 @@ type Chat struct {
 	Users []primitive.ObjectID `bson:"users" json:"users"`
 	Name string `bson:"name,omitempty" json:"name,omitempty"`
 	LastMessage string `bson:"-" json:"lastMessage,omitempty"`
+	UnreadCount int64 `bson:"-" json:"unreadCount"`
+	// Pins are kept in pinning order, clients get PinnedMessageIDs with the
+	// latest pin first.
+	Pins []*Pin `bson:"pins,omitempty" json:"-"`
+	PinnedMessageIDs []primitive.ObjectID `bson:"-" json:"pinnedMessageIds,omitempty"`
+}
+
+// Pin is a message pinned to the top of a chat.
+type Pin struct {
+	MessageID primitive.ObjectID `bson:"messageId" json:"messageId"`
+	PinnedBy primitive.ObjectID `bson:"pinnedBy" json:"pinnedBy"`
+	PinnedAt int64 `bson:"pinnedAt" json:"pinnedAt"`
+}
+
+// FillPinnedMessageIDs sets PinnedMessageIDs from Pins.
+func (c *Chat) FillPinnedMessageIDs() {
+	c.PinnedMessageIDs = nil
+	for i := len(c.Pins) - 1; i >= 0; i-- {
+		c.PinnedMessageIDs = append(c.PinnedMessageIDs, c.Pins[i].MessageID)
+	}
+}
+
+func (c *Chat) HasUser(userID primitive.ObjectID) bool {
+	for _, id := range c.Users {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"unicode/utf8"
+
+	"uberMessenger/src/drafts"
+	"uberMessenger/src/hub"
+	"uberMessenger/src/messages"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// DraftParams is sent to /saveDraft and with draft.save. Saving an empty
+// draft clears it.
+type DraftParams struct {
+	ChatID  string `json:"chatId"`
+	Text    string `json:"text"`
+	ReplyTo string `json:"replyTo,omitempty"`
+}
+
+// DraftUpdatedPayload tells the other devices of a user that a draft
+// changed, Draft is nil once it is cleared.
+type DraftUpdatedPayload struct {
+	ChatID primitive.ObjectID `json:"chatId"`
+	Draft  *drafts.Draft      `json:"draft"`
+}
+
+// saveDraft stores the user's draft in a chat, or clears it if it is empty,
+// and sends it to the user's devices except the one it came from. from is
+// nil for drafts saved over HTTP.
+func (e *Endpoints) saveDraft(ctx context.Context, userID primitive.ObjectID, params *DraftParams, from *hub.Conn) (*drafts.Draft, error) {
+	chatID, err := primitive.ObjectIDFromHex(params.ChatID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	_, err = e.authorizeChat(ctx, userID, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if utf8.RuneCountInString(params.Text) > drafts.MaxTextRunes {
+		return nil, fmt.Errorf("%w: drafts are limited to %d characters", errBadRequest, drafts.MaxTextRunes)
+	}
+
+	if params.Text == "" && params.ReplyTo == "" {
+		return nil, e.clearDraft(ctx, userID, chatID, from)
+	}
+
+	var replyTo *primitive.ObjectID
+	if params.ReplyTo != "" {
+		msg, err := e.authorizeMessage(ctx, userID, params.ReplyTo)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.ChatID != chatID {
+			return nil, fmt.Errorf("%w: replied message is not in this chat", errBadRequest)
+		}
+		replyTo = &msg.ID
+	}
+
+	draft, err := e.DraftDAO.SaveDraft(ctx, userID, chatID, params.Text, replyTo)
+	if err != nil {
+		return nil, err
+	}
+
+	e.publishDraft(userID, chatID, draft, from)
+
+	return draft, nil
+}
+
+// clearDraft removes the user's draft in a chat, if there is one.
+func (e *Endpoints) clearDraft(ctx context.Context, userID, chatID primitive.ObjectID, from *hub.Conn) error {
+	cleared, err := e.DraftDAO.ClearDraft(ctx, userID, chatID)
+	if err != nil {
+		return err
+	}
+
+	if cleared {
+		e.publishDraft(userID, chatID, nil, from)
+	}
+
+	return nil
+}
+
+// discardDraft clears the sender's draft in the chat of msg if it holds the
+// text they just sent. A draft with other text is being written on another
+// device and stays.
+func (e *Endpoints) discardDraft(ctx context.Context, msg *messages.Message, text string) {
+	if msg.ThreadRootID != nil || text == "" {
+		return
+	}
+
+	cleared, err := e.DraftDAO.ClearDraftWithText(ctx, msg.From, msg.ChatID, text)
+	if err != nil {
+		log.Printf("Draft error: %s", err)
+		return
+	}
+
+	if cleared {
+		e.publishDraft(msg.From, msg.ChatID, nil, nil)
+	}
+}
+
+func (e *Endpoints) publishDraft(userID, chatID primitive.ObjectID, draft *drafts.Draft, from *hub.Conn) {
+	payload := &DraftUpdatedPayload{ChatID: chatID, Draft: draft}
+
+	var err error
+	if from != nil {
+		err = e.hub.PublishToOthers(from, hub.EventDraftUpdated, payload)
+	} else {
+		err = e.hub.Publish([]primitive.ObjectID{userID}, hub.EventDraftUpdated, payload)
+	}
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+// SaveDraftHandler stores the caller's draft in a chat. The saved draft is
+// returned, or null if it was cleared.
+func (e *Endpoints) SaveDraftHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params DraftParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	draft, err := e.saveDraft(ctx, userID, &params, nil)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(draft)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+type ClearDraftParams struct {
+	ChatID string `json:"chatId"`
+}
+
+func (e *Endpoints) ClearDraftHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params ClearDraftParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	chatID, err := primitive.ObjectIDFromHex(params.ChatID)
+	if err != nil {
+		e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+		return
+	}
+
+	_, err = e.authorizeChat(ctx, userID, chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	err = e.clearDraft(ctx, userID, chatID, nil)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+}
+
+// GetDrafts returns the caller's drafts, in the chat given by chatId or in
+// all their chats.
+func (e *Endpoints) GetDrafts(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	ctx := context.TODO()
+	userID := userIDFromContext(r.Context())
+
+	result := []*drafts.Draft{}
+	if value := r.URL.Query().Get("chatId"); value != "" {
+		chatID, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+			return
+		}
+
+		_, err = e.authorizeChat(ctx, userID, chatID)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+
+		draft, err := e.DraftDAO.GetDraft(ctx, userID, chatID)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+		if draft != nil {
+			result = append(result, draft)
+		}
+	} else {
+		var err error
+		result, err = e.DraftDAO.GetDraftsByUser(ctx, userID)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
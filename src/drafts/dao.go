@@ -0,0 +1,145 @@
+package drafts
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+const (
+	DBName         = "messenger"
+	CollectionName = "drafts"
+)
+
+type DAO struct {
+	client     *mongo.Client
+	db         *mongo.Database
+	collection *mongo.Collection
+}
+
+func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
+	db := client.Database(DBName)
+	collection := db.Collection(CollectionName)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Options: options.Index().SetUnique(true),
+		Keys: bsonx.Doc{
+			{"userId", bsonx.Int32(1)},
+			{"chatId", bsonx.Int32(1)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DAO{
+		client:     client,
+		db:         db,
+		collection: collection,
+	}, nil
+}
+
+// GetDraft returns the user's draft in the chat or nil if there is none.
+func (dao *DAO) GetDraft(ctx context.Context, userID, chatID primitive.ObjectID) (*Draft, error) {
+	filter := bson.D{{"userId", userID}, {"chatId", chatID}}
+
+	var draft *Draft
+	err := dao.collection.FindOne(ctx, filter).Decode(&draft)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return draft, nil
+}
+
+// GetDraftsByUser returns the drafts of the user in every chat.
+func (dao *DAO) GetDraftsByUser(ctx context.Context, userID primitive.ObjectID) ([]*Draft, error) {
+	filter := bson.D{{"userId", userID}}
+	opts := options.Find().SetSort(bson.D{{"updatedAt", -1}})
+
+	cursor, err := dao.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*Draft{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SaveDraft replaces the user's draft in the chat.
+func (dao *DAO) SaveDraft(ctx context.Context, userID, chatID primitive.ObjectID, text string, replyTo *primitive.ObjectID) (*Draft, error) {
+	filter := bson.D{{"userId", userID}, {"chatId", chatID}}
+
+	set := bson.D{
+		{"text", text},
+		{"updatedAt", time.Now().UnixNano()},
+	}
+	unset := bson.D{}
+	if replyTo != nil {
+		set = append(set, bson.E{"replyTo", *replyTo})
+	} else {
+		unset = append(unset, bson.E{"replyTo", ""})
+	}
+
+	update := bson.D{
+		{"$set", set},
+		{"$setOnInsert", bson.D{{"_id", primitive.NewObjectID()}}},
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.E{"$unset", unset})
+	}
+
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+
+	var draft *Draft
+	err := dao.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&draft)
+	if err != nil {
+		return nil, err
+	}
+
+	return draft, nil
+}
+
+// ClearDraft removes the user's draft in the chat. It returns false if there
+// was none.
+func (dao *DAO) ClearDraft(ctx context.Context, userID, chatID primitive.ObjectID) (bool, error) {
+	filter := bson.D{{"userId", userID}, {"chatId", chatID}}
+
+	result, err := dao.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// ClearDraftWithText removes the user's draft in the chat if its text is
+// text. It returns false if it was not removed.
+func (dao *DAO) ClearDraftWithText(ctx context.Context, userID, chatID primitive.ObjectID, text string) (bool, error) {
+	filter := bson.D{{"userId", userID}, {"chatId", chatID}, {"text", text}}
+
+	result, err := dao.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+func (dao *DAO) Drop(ctx context.Context) error {
+	return dao.collection.Drop(ctx)
+}
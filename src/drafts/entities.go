@@ -0,0 +1,19 @@
+package drafts
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxTextRunes caps the length of a draft.
+const MaxTextRunes = 4096
+
+// Draft is the unsent text a user left in a chat. It is shared by all their
+// devices, the latest save wins.
+type Draft struct {
+	ID        primitive.ObjectID  `bson:"_id" json:"-"`
+	UserID    primitive.ObjectID  `bson:"userId" json:"-"`
+	ChatID    primitive.ObjectID  `bson:"chatId" json:"chatId"`
+	Text      string              `bson:"text" json:"text"`
+	ReplyTo   *primitive.ObjectID `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+	UpdatedAt int64               `bson:"updatedAt" json:"updatedAt"`
+}
@@ -0,0 +1,77 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Event is a realtime event travelling through the backplane. It is
+// addressed either to explicit Users or, if Users is empty, to the members
+// of ChatID which every instance resolves on delivery. Seqs holds the seq
+// each recipient's event log gave a replayable event, by user ID. Except
+// names a connection that is skipped, usually the one whose command caused
+// the event.
+type Event struct {
+	Type    string               `bson:"type"`
+	Seqs    map[string]int64     `bson:"seqs,omitempty"`
+	ChatID  primitive.ObjectID   `bson:"chatId,omitempty"`
+	Users   []primitive.ObjectID `bson:"users,omitempty"`
+	Except  string               `bson:"except,omitempty"`
+	Payload json.RawMessage      `bson:"payload"`
+}
+
+func NewEvent(eventType string, payload interface{}) (*Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{Type: eventType, Payload: data}, nil
+}
+
+// SeqOf returns the seq of the event in the user's event log, 0 if it was
+// not logged for them.
+func (e *Event) SeqOf(userID primitive.ObjectID) int64 {
+	return e.Seqs[userID.Hex()]
+}
+
+// Backplane distributes events between server instances. Every event
+// published on any instance is passed to the subscriber of every instance,
+// including the one that published it.
+type Backplane interface {
+	Publish(ctx context.Context, event *Event) error
+	Subscribe(handler func(event *Event))
+}
+
+// MemoryBackplane delivers events within the process. It is enough when a
+// single instance is running.
+type MemoryBackplane struct {
+	mu      sync.RWMutex
+	handler func(event *Event)
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, event *Event) error {
+	b.mu.RLock()
+	handler := b.handler
+	b.mu.RUnlock()
+
+	if handler != nil {
+		handler(event)
+	}
+
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(handler func(event *Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handler = handler
+}
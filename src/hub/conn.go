@@ -0,0 +1,264 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = pongWait * 9 / 10
+
+	// Maximum size of a message read from the peer.
+	maxMessageSize = 64 * 1024
+
+	// Messages queued for a connection before it is considered too slow and
+	// dropped. The client is expected to reconnect.
+	sendQueueSize = 256
+)
+
+// Conn is a single websocket connection of a user. Writes happen on a
+// dedicated goroutine fed by a bounded queue, so a slow client never blocks
+// delivery to others.
+type Conn struct {
+	// ID tells the connections of a user apart, on every instance.
+	ID     string
+	UserID primitive.ObjectID
+
+	hub  *Hub
+	ws   *websocket.Conn
+	send chan []byte
+
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mu      sync.Mutex
+	paused  bool
+	pending []pendingEvent
+
+	// away is guarded by the hub's lock, see Hub.SetAway.
+	away bool
+}
+
+type pendingEvent struct {
+	seq  int64
+	data []byte
+}
+
+func newConn(h *Hub, userID primitive.ObjectID, ws *websocket.Conn) *Conn {
+	return &Conn{
+		ID:     primitive.NewObjectID().Hex(),
+		UserID: userID,
+		hub:    h,
+		ws:     ws,
+		send:   make(chan []byte, sendQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// Send queues data for writing. It returns false if the connection is closed
+// or its queue is full, in which case the connection is closed.
+func (c *Conn) Send(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return true
+	case <-c.done:
+		return false
+	default:
+		log.Printf("Websocket send queue of user %s is full, closing connection", c.UserID.Hex())
+		go c.hub.Unregister(c)
+		return false
+	}
+}
+
+// deliver sends a published event, or holds it back while the connection is
+// paused.
+func (c *Conn) deliver(seq int64, data []byte) {
+	c.mu.Lock()
+	if c.paused {
+		if len(c.pending) < sendQueueSize {
+			c.pending = append(c.pending, pendingEvent{seq: seq, data: data})
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+
+		log.Printf("Websocket replay of user %s fell too far behind, closing connection", c.UserID.Hex())
+		go c.hub.Unregister(c)
+		return
+	}
+	c.mu.Unlock()
+
+	c.Send(data)
+}
+
+// SendReplayed queues a replayed event for this connection, bypassing the
+// pause.
+func (c *Conn) SendReplayed(eventType string, seq int64, payload interface{}) bool {
+	env, err := NewEnvelope(eventType, "", payload)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+		return false
+	}
+	env.Seq = seq
+
+	return c.sendEnvelope(env)
+}
+
+// Resume delivers the events held back while the connection was paused,
+// skipping replayable ones with a seq up to afterSeq that were already
+// replayed, and switches to live delivery.
+func (c *Conn) Resume(afterSeq int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, event := range c.pending {
+		if event.seq != 0 && event.seq <= afterSeq {
+			continue
+		}
+		c.Send(event.data)
+	}
+
+	c.pending = nil
+	c.paused = false
+}
+
+// Close stops the connection loops and closes the socket. It is safe to call
+// more than once.
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Done is closed when the connection is closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Conn) readLoop() {
+	defer c.hub.Unregister(c)
+
+	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("Websocket error: %s", err)
+			}
+			return
+		}
+
+		c.handle(data)
+	}
+}
+
+func (c *Conn) handle(data []byte) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		c.SendError("", errors.New("malformed envelope"))
+		return
+	}
+
+	if env.Version != ProtocolVersion {
+		c.SendError(env.ID, fmt.Errorf("unsupported protocol version %d", env.Version))
+		return
+	}
+
+	if c.hub.handler == nil {
+		return
+	}
+
+	result, err := c.hub.handler(c, &env)
+	if err != nil {
+		c.SendError(env.ID, err)
+		return
+	}
+
+	if env.ID != "" {
+		c.SendEvent(EventAck, env.ID, result)
+	}
+}
+
+// SendEvent queues an envelope for this connection only.
+func (c *Conn) SendEvent(eventType, id string, payload interface{}) bool {
+	env, err := NewEnvelope(eventType, id, payload)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+		return false
+	}
+
+	return c.sendEnvelope(env)
+}
+
+func (c *Conn) sendEnvelope(env *Envelope) bool {
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+		return false
+	}
+
+	return c.Send(data)
+}
+
+// SendError reports a failed command back to the client.
+func (c *Conn) SendError(id string, err error) bool {
+	return c.SendEvent(EventError, id, &ErrorPayload{Message: err.Error()})
+}
+
+func (c *Conn) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.ws.Close()
+	}()
+
+	for {
+		select {
+		case data := <-c.send:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Websocket error: %s", err)
+				go c.hub.Unregister(c)
+				return
+			}
+
+		case <-ticker.C:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+				go c.hub.Unregister(c)
+				return
+			}
+
+		case <-c.done:
+			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+			c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
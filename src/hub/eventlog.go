@@ -0,0 +1,213 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+// LogCollectionName holds the replayable events of every user and
+// SeqCollectionName the last seq given to each of them.
+const (
+	LogCollectionName = "userEvents"
+	SeqCollectionName = "userEventSeqs"
+)
+
+const (
+	// LogTTL is how long events are kept for replay. A client that was
+	// away for longer has to resync.
+	LogTTL = 7 * 24 * time.Hour
+
+	// reserveWorkers bounds the seqs reserved at once for the recipients
+	// of one event.
+	reserveWorkers = 16
+)
+
+// LoggedEvent is an event as recorded for one of its recipients.
+type LoggedEvent struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	Seq       int64              `bson:"seq"`
+	Type      string             `bson:"type"`
+	Payload   json.RawMessage    `bson:"payload"`
+	CreatedAt time.Time          `bson:"createdAt"`
+}
+
+type seqCounter struct {
+	UserID primitive.ObjectID `bson:"_id"`
+	Seq    int64              `bson:"seq"`
+}
+
+// EventLog numbers the events of every user with a seq of their own and
+// keeps them for LogTTL for replay.
+//
+// Seqs come from a counter per user, so they grow by one with each event.
+// Events appended concurrently may be stored out of seq order, and the seq
+// of an event that failed to be stored stays missing for good.
+type EventLog struct {
+	collection *mongo.Collection
+	seqs       *mongo.Collection
+}
+
+func NewEventLog(ctx context.Context, db *mongo.Database) (*EventLog, error) {
+	collection := db.Collection(LogCollectionName)
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Options: options.Index().SetUnique(true),
+			Keys: bsonx.Doc{
+				{"userId", bsonx.Int32(1)},
+				{"seq", bsonx.Int32(1)},
+			},
+		},
+		{
+			Options: options.Index().SetExpireAfterSeconds(int32(LogTTL / time.Second)),
+			Keys: bsonx.MDoc{
+				"createdAt": bsonx.Int32(1),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventLog{
+		collection: collection,
+		seqs:       db.Collection(SeqCollectionName),
+	}, nil
+}
+
+// Append records event for users and returns the seqs they got, keyed by
+// user like Event.Seqs. Seqs are returned along with an error when only
+// some of the users got one or the event could not be stored for them; it
+// still goes out live then, it just cannot be replayed.
+func (l *EventLog) Append(ctx context.Context, users []primitive.ObjectID, event *Event) (map[string]int64, error) {
+	seqs, err := l.reserve(ctx, users)
+
+	now := time.Now()
+	entries := make([]interface{}, 0, len(seqs))
+	for _, userID := range users {
+		seq, ok := seqs[userID.Hex()]
+		if !ok {
+			continue
+		}
+
+		entries = append(entries, &LoggedEvent{
+			ID:        primitive.NewObjectID(),
+			UserID:    userID,
+			Seq:       seq,
+			Type:      event.Type,
+			Payload:   event.Payload,
+			CreatedAt: now,
+		})
+	}
+
+	if len(entries) > 0 {
+		opts := options.InsertMany().SetOrdered(false)
+		if _, insertErr := l.collection.InsertMany(ctx, entries, opts); insertErr != nil {
+			err = insertErr
+		}
+	}
+
+	return seqs, err
+}
+
+// reserve takes the next seq of every user, a few users at a time.
+func (l *EventLog) reserve(ctx context.Context, users []primitive.ObjectID) (map[string]int64, error) {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		seqs     = make(map[string]int64, len(users))
+		firstErr error
+	)
+
+	workers := make(chan struct{}, reserveWorkers)
+	for _, userID := range users {
+		wg.Add(1)
+		workers <- struct{}{}
+
+		go func(userID primitive.ObjectID) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			seq, err := l.next(ctx, userID)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			seqs[userID.Hex()] = seq
+		}(userID)
+	}
+	wg.Wait()
+
+	return seqs, firstErr
+}
+
+func (l *EventLog) next(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	filter := bson.D{{"_id", userID}}
+	update := bson.D{{"$inc", bson.D{{"seq", 1}}}}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.After)
+
+	var counter seqCounter
+	err := l.seqs.FindOneAndUpdate(ctx, filter, update, opts).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Seq, nil
+}
+
+// LastSeq returns the last seq given to the user, 0 if there is none.
+func (l *EventLog) LastSeq(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	filter := bson.D{{"_id", userID}}
+
+	var counter seqCounter
+	err := l.seqs.FindOne(ctx, filter).Decode(&counter)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Seq, nil
+}
+
+// After returns up to limit events of the user with a seq greater than
+// afterSeq, oldest first.
+func (l *EventLog) After(ctx context.Context, userID primitive.ObjectID, afterSeq int64, limit int) ([]*LoggedEvent, error) {
+	filter := bson.D{
+		{"userId", userID},
+		{"seq", bson.D{{"$gt", afterSeq}}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"seq", 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := l.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*LoggedEvent
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,276 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Hub keeps track of the open websocket connections of every user. A user
+// may have any number of connections (phone, laptop, several tabs) and
+// everything sent to the user is delivered to all of them.
+type Hub struct {
+	mu        sync.RWMutex
+	conns     map[primitive.ObjectID]map[*Conn]struct{}
+	handler   Handler
+	backplane Backplane
+	resolve   Resolver
+	presence  PresenceHandler
+	log       *EventLog
+}
+
+// Resolver returns the members of a chat, for events addressed to a chat.
+type Resolver func(ctx context.Context, chatID primitive.ObjectID) ([]primitive.ObjectID, error)
+
+// New returns a hub that passes commands received from clients to handler.
+// Events are published through backplane and delivered to the local
+// connections of their recipients when the backplane hands them back.
+func New(handler Handler, backplane Backplane, resolve Resolver) *Hub {
+	h := &Hub{
+		conns:     make(map[primitive.ObjectID]map[*Conn]struct{}),
+		handler:   handler,
+		backplane: backplane,
+		resolve:   resolve,
+	}
+
+	backplane.Subscribe(h.deliver)
+
+	return h
+}
+
+// SetLog makes the hub record replayable events in log before publishing
+// them.
+func (h *Hub) SetLog(log *EventLog) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.log = log
+}
+
+// Register adds ws as a connection of userID and starts its read and write
+// loops. The connection unregisters itself when it is closed.
+func (h *Hub) Register(userID primitive.ObjectID, ws *websocket.Conn) *Conn {
+	return h.register(newConn(h, userID, ws))
+}
+
+// RegisterPaused registers a connection that holds back live events until
+// Resume is called, so that missed events can be replayed first.
+func (h *Hub) RegisterPaused(userID primitive.ObjectID, ws *websocket.Conn) *Conn {
+	c := newConn(h, userID, ws)
+	c.paused = true
+
+	return h.register(c)
+}
+
+func (h *Hub) register(c *Conn) *Conn {
+	userID := c.UserID
+
+	h.mu.Lock()
+	userConns, ok := h.conns[userID]
+	if !ok {
+		userConns = make(map[*Conn]struct{})
+		h.conns[userID] = userConns
+	}
+	before := h.presenceLocked(userID)
+	userConns[c] = struct{}{}
+	after := h.presenceLocked(userID)
+	h.mu.Unlock()
+
+	if before != after {
+		h.notifyPresence(userID)
+	}
+
+	go c.writeLoop()
+	go c.readLoop()
+
+	return c
+}
+
+// Unregister removes the connection from the hub and closes it.
+func (h *Hub) Unregister(c *Conn) {
+	h.mu.Lock()
+	before := h.presenceLocked(c.UserID)
+	if userConns, ok := h.conns[c.UserID]; ok {
+		delete(userConns, c)
+		if len(userConns) == 0 {
+			delete(h.conns, c.UserID)
+		}
+	}
+	after := h.presenceLocked(c.UserID)
+	h.mu.Unlock()
+
+	c.Close()
+
+	if before != after {
+		h.notifyPresence(c.UserID)
+	}
+}
+
+// Publish sends an event with the given payload to every connection of the
+// users, on every instance.
+func (h *Hub) Publish(userIDs []primitive.ObjectID, eventType string, payload interface{}) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	event, err := NewEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	event.Users = userIDs
+
+	return h.PublishEvent(event)
+}
+
+// PublishToChat sends an event with the given payload to every member of
+// the chat, on every instance.
+func (h *Hub) PublishToChat(chatID primitive.ObjectID, eventType string, payload interface{}) error {
+	event, err := NewEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	event.ChatID = chatID
+
+	return h.PublishEvent(event)
+}
+
+// PublishToOthers sends an event with the given payload to every connection
+// of the user of c except c itself, on every instance.
+func (h *Hub) PublishToOthers(c *Conn, eventType string, payload interface{}) error {
+	event, err := NewEvent(eventType, payload)
+	if err != nil {
+		return err
+	}
+	event.Users = []primitive.ObjectID{c.UserID}
+	event.Except = c.ID
+
+	return h.PublishEvent(event)
+}
+
+// PublishEvent sends a prepared event to its recipients on every instance.
+// Replayable events are first recorded in the event log of every recipient.
+func (h *Hub) PublishEvent(event *Event) error {
+	ctx := context.Background()
+
+	h.mu.RLock()
+	eventLog := h.log
+	h.mu.RUnlock()
+
+	if eventLog != nil && Replayable(event.Type) {
+		err := h.record(ctx, eventLog, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.backplane.Publish(ctx, event)
+}
+
+// record appends event to the logs of its recipients. A chat event is
+// addressed to the members it was logged for from then on.
+func (h *Hub) record(ctx context.Context, eventLog *EventLog, event *Event) error {
+	users := event.Users
+	if len(users) == 0 && !event.ChatID.IsZero() {
+		var err error
+		users, err = h.resolve(ctx, event.ChatID)
+		if err != nil {
+			return err
+		}
+		event.Users = users
+	}
+
+	seqs, err := eventLog.Append(ctx, users, event)
+	if err != nil {
+		// The event still goes out live, only its replay is lost.
+		log.Printf("Event log error: %s", err)
+	}
+	event.Seqs = seqs
+
+	return nil
+}
+
+// deliver sends an event coming from the backplane to local connections.
+func (h *Hub) deliver(event *Event) {
+	users := event.Users
+	if len(users) == 0 && !event.ChatID.IsZero() {
+		var err error
+		users, err = h.resolve(context.Background(), event.ChatID)
+		if err != nil {
+			log.Printf("Websocket error: %s", err)
+			return
+		}
+	}
+
+	// Every recipient gets the event with the seq of their own log.
+	for _, userID := range users {
+		conns := h.connsOf([]primitive.ObjectID{userID})
+		if len(conns) == 0 {
+			continue
+		}
+
+		env := &Envelope{
+			Version: ProtocolVersion,
+			Type:    event.Type,
+			Seq:     event.SeqOf(userID),
+			Payload: event.Payload,
+		}
+
+		data, err := json.Marshal(env)
+		if err != nil {
+			log.Printf("Websocket error: %s", err)
+			continue
+		}
+
+		for _, c := range conns {
+			if c.ID == event.Except {
+				continue
+			}
+			c.deliver(env.Seq, data)
+		}
+	}
+}
+
+// SendToUser queues v, encoded as JSON, on every connection of the user.
+func (h *Hub) SendToUser(userID primitive.ObjectID, v interface{}) error {
+	return h.SendToUsers([]primitive.ObjectID{userID}, v)
+}
+
+// SendToUsers queues v, encoded as JSON, on every connection of the users.
+func (h *Hub) SendToUsers(userIDs []primitive.ObjectID, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range h.connsOf(userIDs) {
+		c.Send(data)
+	}
+
+	return nil
+}
+
+// Connections returns the number of open connections of the user.
+func (h *Hub) Connections(userID primitive.ObjectID) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.conns[userID])
+}
+
+func (h *Hub) connsOf(userIDs []primitive.ObjectID) []*Conn {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var result []*Conn
+	for _, userID := range userIDs {
+		for c := range h.conns[userID] {
+			result = append(result, c)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,118 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+// EventsCollectionName holds every published event until each instance has
+// seen it through the change stream. Events are removed after a minute.
+const EventsCollectionName = "realtimeEvents"
+
+const eventsTTL = 60
+
+// MongoBackplane distributes events through MongoDB change streams, so every
+// instance connected to the same replica set sees every event. Change
+// streams are not available on a standalone mongod.
+type MongoBackplane struct {
+	events *mongo.Collection
+
+	mu      sync.RWMutex
+	handler func(event *Event)
+}
+
+type storedEvent struct {
+	Event     `bson:",inline"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+func NewMongoBackplane(ctx context.Context, db *mongo.Database) (*MongoBackplane, error) {
+	events := db.Collection(EventsCollectionName)
+
+	_, err := events.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Options: options.Index().SetExpireAfterSeconds(eventsTTL),
+		Keys: bsonx.MDoc{
+			"createdAt": bsonx.Int32(1),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b := &MongoBackplane{events: events}
+	go b.watch()
+
+	return b, nil
+}
+
+func (b *MongoBackplane) Publish(ctx context.Context, event *Event) error {
+	_, err := b.events.InsertOne(ctx, &storedEvent{
+		Event:     *event,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+func (b *MongoBackplane) Subscribe(handler func(event *Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handler = handler
+}
+
+type changeEvent struct {
+	FullDocument Event `bson:"fullDocument"`
+}
+
+// watch follows inserts into the events collection for as long as the
+// process runs, resuming after the last seen change when the stream breaks.
+func (b *MongoBackplane) watch() {
+	ctx := context.Background()
+	pipeline := mongo.Pipeline{
+		{{"$match", bson.D{{"operationType", "insert"}}}},
+	}
+
+	var resumeToken bson.Raw
+	for {
+		opts := options.ChangeStream()
+		if resumeToken != nil {
+			opts.SetResumeAfter(resumeToken)
+		}
+
+		stream, err := b.events.Watch(ctx, pipeline, opts)
+		if err != nil {
+			log.Printf("Backplane error: watch: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for stream.Next(ctx) {
+			resumeToken = stream.ResumeToken()
+
+			var change changeEvent
+			if err := stream.Decode(&change); err != nil {
+				log.Printf("Backplane error: %s", err)
+				continue
+			}
+
+			b.mu.RLock()
+			handler := b.handler
+			b.mu.RUnlock()
+
+			if handler != nil {
+				handler(&change.FullDocument)
+			}
+		}
+
+		log.Printf("Backplane error: watch: %v", stream.Err())
+		stream.Close(ctx)
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Presence of a user as seen from the connections of this instance. A user
+// is away when every connection reported being away.
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// PresenceHandler is called when the presence of a user may have changed:
+// on the first and last connection and when a connection goes away or comes
+// back. It runs on its own goroutine and should read the current state with
+// Presence.
+type PresenceHandler func(userID primitive.ObjectID)
+
+func (h *Hub) SetPresenceHandler(handler PresenceHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.presence = handler
+}
+
+// Presence returns the presence of the user on this instance.
+func (h *Hub) Presence(userID primitive.ObjectID) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.presenceLocked(userID)
+}
+
+func (h *Hub) presenceLocked(userID primitive.ObjectID) string {
+	userConns := h.conns[userID]
+	if len(userConns) == 0 {
+		return PresenceOffline
+	}
+
+	for c := range userConns {
+		if !c.away {
+			return PresenceOnline
+		}
+	}
+
+	return PresenceAway
+}
+
+// SetAway marks the connection as away, e.g. when its window lost focus.
+func (h *Hub) SetAway(c *Conn, away bool) {
+	h.mu.Lock()
+	before := h.presenceLocked(c.UserID)
+	c.away = away
+	after := h.presenceLocked(c.UserID)
+	h.mu.Unlock()
+
+	if before != after {
+		h.notifyPresence(c.UserID)
+	}
+}
+
+// OnlineUsers returns the users connected to this instance.
+func (h *Hub) OnlineUsers() []primitive.ObjectID {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]primitive.ObjectID, 0, len(h.conns))
+	for userID := range h.conns {
+		result = append(result, userID)
+	}
+
+	return result
+}
+
+func (h *Hub) notifyPresence(userID primitive.ObjectID) {
+	h.mu.RLock()
+	handler := h.presence
+	h.mu.RUnlock()
+
+	if handler != nil {
+		go handler(userID)
+	}
+}
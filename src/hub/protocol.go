@@ -0,0 +1,110 @@
+package hub
+
+import (
+	"encoding/json"
+)
+
+// ProtocolVersion is sent in every envelope. It is bumped on incompatible
+// changes of the envelope or of event payloads.
+const ProtocolVersion = 1
+
+// Events sent by the server.
+const (
+	EventMessageCreated = "message.created"
+	EventMessageUpdated = "message.updated"
+	EventMessageDeleted = "message.deleted"
+	// Replies in threads are sent as thread.reply.created instead of
+	// message.created so that they stay off the main timeline. The root's
+	// counters are updated with thread.updated.
+	EventThreadReplyCreated = "thread.reply.created"
+	EventThreadUpdated      = "thread.updated"
+	EventReactionUpdated    = "reaction.updated"
+	EventMessageStatus      = "message.status"
+	EventMessagesRead       = "messages.read"
+	EventPinUpdated         = "pin.updated"
+	EventMention            = "mention"
+	EventPollUpdated        = "poll.updated"
+	EventDraftUpdated       = "draft.updated"
+	EventChatCreated        = "chat.created"
+	EventTyping             = "typing"
+	EventReadReceipt        = "read.receipt"
+	EventPresence           = "presence"
+	EventReplayDone         = "replay.done"
+	EventResync             = "resync"
+	EventAck                = "ack"
+	EventError              = "error"
+)
+
+// Replayable tells whether events of the type are logged for replay after a
+// reconnect. Typing and presence only matter while they happen.
+func Replayable(eventType string) bool {
+	switch eventType {
+	case EventTyping, EventPresence, EventReplayDone, EventResync, EventAck, EventError:
+		return false
+	}
+
+	return true
+}
+
+// Commands sent by clients.
+const (
+	CommandSendMessage = "message.send"
+	CommandAckMessages = "message.ack"
+	CommandTypingStart = "typing.start"
+	CommandTypingStop  = "typing.stop"
+	CommandPresenceSet = "presence.set"
+	CommandDraftSave   = "draft.save"
+)
+
+// Envelope wraps everything sent over the socket in either direction. ID is
+// chosen by the client for commands and echoed back in the ack or error
+// that answers them; server pushed events have no ID.
+//
+// Seq is the cursor of replayable events. Every user has their own seqs,
+// which grow by one with each event. Events may arrive out of order when
+// they are published concurrently, so a client keeps the seq up to which it
+// has seen every event and passes it back when reconnecting to get the
+// events it missed. Events replayed twice are recognised by their seq. A
+// seq that never arrives, because its event could not be logged, ends in a
+// resync on the next reconnect.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Seq     int64           `json:"seq,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ReplayPayload is sent with replay.done once the missed events have been
+// replayed, or with resync when they cannot be. Cursor is the seq the client
+// continues from, a connection without a cursor gets the current one.
+type ReplayPayload struct {
+	Cursor int64 `json:"cursor"`
+}
+
+type ErrorPayload struct {
+	Message string `json:"message"`
+}
+
+// Handler processes commands received from a connection. Commands sent with
+// an ID are acked to the client with the result, which may be nil; an error
+// is reported back as an error event instead.
+type Handler func(c *Conn, env *Envelope) (interface{}, error)
+
+func NewEnvelope(eventType, id string, payload interface{}) (*Envelope, error) {
+	env := &Envelope{
+		Version: ProtocolVersion,
+		Type:    eventType,
+		ID:      id,
+	}
+
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		env.Payload = data
+	}
+
+	return env, nil
+}
@@ -0,0 +1,209 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"uberMessenger/src/messages"
+)
+
+var ErrNoPreview = errors.New("page has no preview")
+var errPrivateAddress = errors.New("refusing to fetch a private address")
+
+// Fetcher builds the preview of a link. It is an interface so that the
+// server can run without fetching anything, or with a stub.
+type Fetcher interface {
+	Fetch(ctx context.Context, link string) (*messages.LinkPreview, error)
+}
+
+// HTTPFetcher reads Open Graph tags, or the title, from the head of a page.
+// It only connects to public addresses, so links cannot be used to probe the
+// server's network.
+type HTTPFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+func NewHTTPFetcher() *HTTPFetcher {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublic(ip) {
+				return errPrivateAddress
+			}
+
+			return nil
+		},
+	}
+
+	return &HTTPFetcher{
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 5 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 3 {
+					return errors.New("too many redirects")
+				}
+				return nil
+			},
+		},
+		maxBytes: 512 * 1024,
+	}
+}
+
+var privateNetworks []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12",
+		"192.168.0.0/16", "198.18.0.0/15", "fc00::/7",
+		// Addresses that embed an IPv4 one: NAT64 and IPv4-compatible.
+		"64:ff9b::/96", "64:ff9b:1::/48", "::/96",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNetworks = append(privateNetworks, network)
+	}
+}
+
+func isPublic(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+var (
+	metaTag   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attribute = regexp.MustCompile(`(?is)([a-z:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+	titleTag  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+)
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, link string) (*messages.LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", link, resp.Status)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		return nil, ErrNoPreview
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.maxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	preview := parsePage(string(body))
+	preview.Image = resolveImage(resp.Request.URL, preview.Image)
+	if preview.Title == "" && preview.Description == "" && preview.Image == "" {
+		return nil, ErrNoPreview
+	}
+	preview.URL = link
+
+	return preview, nil
+}
+
+// resolveImage makes an image given relative to the page absolute. Anything
+// but an http or https URL is dropped.
+func resolveImage(page *url.URL, image string) string {
+	if image == "" {
+		return ""
+	}
+
+	ref, err := url.Parse(image)
+	if err != nil {
+		return ""
+	}
+
+	resolved := page.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+
+	return resolved.String()
+}
+
+// parsePage picks the preview out of a page, Open Graph tags first.
+func parsePage(page string) *messages.LinkPreview {
+	meta := make(map[string]string)
+	for _, tag := range metaTag.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attribute.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3]
+		}
+
+		name := attrs["property"]
+		if name == "" {
+			name = attrs["name"]
+		}
+		name = strings.ToLower(name)
+		if _, ok := meta[name]; !ok && name != "" {
+			meta[name] = html.UnescapeString(strings.TrimSpace(attrs["content"]))
+		}
+	}
+
+	preview := &messages.LinkPreview{
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+		Image:       meta["og:image"],
+	}
+
+	if preview.Title == "" {
+		if m := titleTag.FindStringSubmatch(page); m != nil {
+			preview.Title = html.UnescapeString(strings.TrimSpace(m[1]))
+		}
+	}
+	if preview.Description == "" {
+		preview.Description = meta["description"]
+	}
+
+	return preview
+}
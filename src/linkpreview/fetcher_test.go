@@ -0,0 +1,130 @@
+package linkpreview
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"uberMessenger/src/messages"
+)
+
+func TestParsePage(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want *messages.LinkPreview
+	}{
+		{
+			name: "open graph",
+			page: `<html><head>
+				<meta property="og:title" content="The title">
+				<meta property="og:description" content="About it">
+				<meta property="og:image" content="/img.png">
+				<title>Ignored</title>
+			</head></html>`,
+			want: &messages.LinkPreview{
+				Title:       "The title",
+				Description: "About it",
+				Image:       "/img.png",
+			},
+		},
+		{
+			name: "title and description fallback",
+			page: `<head><TITLE> Plain page </TITLE>
+				<meta name="Description" content="Described"></head>`,
+			want: &messages.LinkPreview{
+				Title:       "Plain page",
+				Description: "Described",
+			},
+		},
+		{
+			name: "attribute order and quotes",
+			page: `<meta content='Single' property='og:title'>`,
+			want: &messages.LinkPreview{Title: "Single"},
+		},
+		{
+			name: "first tag wins",
+			page: `<meta property="og:title" content="First"><meta property="og:title" content="Second">`,
+			want: &messages.LinkPreview{Title: "First"},
+		},
+		{
+			name: "entities unescaped",
+			page: `<meta property="og:title" content="Tom &amp; Jerry"><title>x</title>`,
+			want: &messages.LinkPreview{Title: "Tom & Jerry"},
+		},
+		{
+			name: "nothing",
+			page: `<html><body>hello</body></html>`,
+			want: &messages.LinkPreview{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePage(tt.page)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"169.254.169.254", false},
+		{"255.255.255.255", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::7f00:1", false},
+		{"64:ff9b::a9fe:a9fe", false},
+		{"64:ff9b:1::1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPublic(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublic(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestResolveImage(t *testing.T) {
+	page, _ := url.Parse("https://example.com/posts/1")
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"", ""},
+		{"/img.png", "https://example.com/img.png"},
+		{"img.png", "https://example.com/posts/img.png"},
+		{"//cdn.example.com/a.png", "https://cdn.example.com/a.png"},
+		{"http://other.example/b.png", "http://other.example/b.png"},
+		{"javascript:alert(1)", ""},
+		{"data:image/png;base64,AAAA", ""},
+		{"ftp://example.com/c.png", ""},
+	}
+
+	for _, tt := range tests {
+		if got := resolveImage(page, tt.image); got != tt.want {
+			t.Errorf("resolveImage(%q) = %q, want %q", tt.image, got, tt.want)
+		}
+	}
+}
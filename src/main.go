@@ -2,20 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"mime"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"uberMessenger/src/auth"
 	"uberMessenger/src/chats"
 	"uberMessenger/src/common"
+	"uberMessenger/src/drafts"
+	"uberMessenger/src/hub"
+	"uberMessenger/src/linkpreview"
 	"uberMessenger/src/messages"
+	"uberMessenger/src/receipts"
+	"uberMessenger/src/sessions"
 	"uberMessenger/src/storage"
 	"uberMessenger/src/users"
 
@@ -31,14 +41,22 @@ type Endpoints struct {
 	ChatDAO       *chats.DAO
 	MessageDAO    *messages.DAO
 	AttachmentDAO *storage.DAO
-
-	msgSockets  map[primitive.ObjectID]*websocket.Conn
-	msgUpgrader websocket.Upgrader
+	SessionDAO    *sessions.DAO
+	ReceiptDAO    *receipts.DAO
+	DraftDAO      *drafts.DAO
+	// LinkPreviews fetches previews of links in messages, nil disables them.
+	LinkPreviews linkpreview.Fetcher
+
+	accountThrottle *auth.Throttle
+	ipThrottle      *auth.Throttle
+
+	hub         *hub.Hub
+	eventLog    *hub.EventLog
+	instanceID  string
+	upgrader    websocket.Upgrader
 	msgChannel  chan *messages.Message
-
-	chatSockets  map[primitive.ObjectID]*websocket.Conn
-	chatUpgrader websocket.Upgrader
-	chatChannel  chan *chats.Chat
+	chatChannel chan *chats.Chat
+	typing      *typingTimers
 }
 
 func NewEndpoints(
@@ -46,204 +64,385 @@ func NewEndpoints(
 	ChatDAO *chats.DAO,
 	MessageDAO *messages.DAO,
 	AttachmentDAO *storage.DAO,
+	SessionDAO *sessions.DAO,
+	ReceiptDAO *receipts.DAO,
+	DraftDAO *drafts.DAO,
+	allowedOrigins []string,
+	backplane hub.Backplane,
+	eventLog *hub.EventLog,
 ) *Endpoints {
 	endpoints := &Endpoints{
 		UserDAO:       UserDAO,
 		ChatDAO:       ChatDAO,
 		MessageDAO:    MessageDAO,
 		AttachmentDAO: AttachmentDAO,
+		SessionDAO:    SessionDAO,
+		ReceiptDAO:    ReceiptDAO,
+		DraftDAO:      DraftDAO,
 
-		msgSockets: make(map[primitive.ObjectID]*websocket.Conn),
-		msgUpgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
-		},
-		msgChannel: make(chan *messages.Message, 100),
+		accountThrottle: auth.NewThrottle(5, 15*time.Minute, 15*time.Minute),
+		ipThrottle:      auth.NewThrottle(50, 15*time.Minute, 15*time.Minute),
 
-		chatSockets: make(map[primitive.ObjectID]*websocket.Conn),
-		chatUpgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool {
-				return true
-			},
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  originChecker(allowedOrigins),
+			Subprotocols: []string{bearerProtocol},
 		},
+		msgChannel:  make(chan *messages.Message, 100),
 		chatChannel: make(chan *chats.Chat, 100),
+		typing:      newTypingTimers(),
+		eventLog:    eventLog,
+		instanceID:  primitive.NewObjectID().Hex(),
 	}
+	endpoints.hub = hub.New(endpoints.handleCommand, backplane, endpoints.chatMembers)
+	endpoints.hub.SetLog(eventLog)
+	endpoints.hub.SetPresenceHandler(endpoints.presenceChanged)
 
 	go endpoints.processMessages()
 	go endpoints.processChats()
+	go endpoints.refreshPresence()
+	go endpoints.sendScheduled()
+	go endpoints.reapExpired()
+	go endpoints.closeDuePolls()
 
 	return endpoints
 }
 
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+var errUnauthorized = errors.New("unauthorized")
+var errBadRequest = errors.New("bad request")
+var errForbidden = errors.New("forbidden")
+var errTooManyRequests = errors.New("too many failed attempts, try again later")
+
 type TokenParams struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int64  `json:"expiresIn"`
+}
+
+type RefreshTokenParams struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
-func (e *Endpoints) processMessages() {
+func (e *Endpoints) GetUsersByChatHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	for {
-		msg := <-e.msgChannel
-		chatID := msg.ChatID
-		chat, err := e.ChatDAO.GetChatByID(ctx, chatID)
+	chatIDParam := r.URL.Query().Get("chatId")
+
+	chatID, err := primitive.ObjectIDFromHex(chatIDParam)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	chat, err := e.authorizeChat(ctx, userIDFromContext(r.Context()), chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	var users []*users.User
+
+	for _, userID := range chat.Users {
+		user, err := e.UserDAO.GetUserByID(ctx, userID)
 		if err != nil {
-			log.Printf("Websocket error: %s", err)
-			continue
+			e.handleError(w, err)
+			return
 		}
 
-		for _, userID := range chat.Users {
-			socket, ok := e.msgSockets[userID]
-			if !ok {
-				continue
-			}
-			err := socket.WriteJSON(&msg)
-			if err != nil {
-				log.Printf("Websocket error: %s", err)
-				socket.Close()
-				delete(e.msgSockets, userID)
-			}
-		}
+		users = append(users, user)
 	}
-}
 
-func (e *Endpoints) processChats() {
-	for {
-		chat := <-e.chatChannel
-		for _, userID := range chat.Users {
-			socket, ok := e.chatSockets[userID]
-			if !ok {
-				continue
-			}
-			err := socket.WriteJSON(&chat)
-			if err != nil {
-				log.Printf("Websocket error: %s", err)
-				socket.Close()
-				delete(e.chatSockets, userID)
-			}
-		}
+	bytes, err := json.Marshal(users)
+	if err != nil {
+		e.handleError(w, err)
+		return
 	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
 }
+func (e *Endpoints) GetMe(w http.ResponseWriter, r *http.Request) {
+	userID := userIDFromContext(r.Context())
 
-func (e *Endpoints) GetChatSocketHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	userID, err := primitive.ObjectIDFromHex(id)
+	user, err := e.UserDAO.GetUserByID(context.Background(), userID)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	bytes, err := json.Marshal(user)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	e.chatSockets[userID] = ws
+	w.WriteHeader(200)
+	w.Write(bytes)
+
 }
 
-func (e *Endpoints) GetMessageSocketHandler(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Query().Get("id")
-	userID, err := primitive.ObjectIDFromHex(id)
+type LoginParams struct {
+	NickName string `json:"nickName"`
+	Password string `json:"password"`
+}
+
+// LoginHandler accepts credentials as a JSON or form encoded POST body and
+// starts a new session. Failed attempts are throttled per nickname and per
+// client address.
+func (e *Endpoints) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(200)
+		return
+	}
+	ctx := context.Background()
+
+	params, err := parseLoginParams(r)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+	accountKey := "nickname:" + strings.ToLower(params.NickName)
+	ipKey := "ip:" + clientIP(r)
+
+	if !e.allowAttempt(w, e.accountThrottle, accountKey) || !e.allowAttempt(w, e.ipThrottle, ipKey) {
+		return
+	}
+
+	user, err := e.UserDAO.Authenticate(ctx, params.NickName, params.Password)
+	if err == users.ErrInvalidCredentials {
+		e.accountThrottle.Fail(accountKey)
+		e.ipThrottle.Fail(ipKey)
+		e.handleError(w, err)
+		return
+	}
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	e.msgSockets[userID] = ws
-}
-
-func (e *Endpoints) GetUsersByChatHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	chatIDParam := r.URL.Query().Get("chatId")
+	e.accountThrottle.Reset(accountKey)
 
-	chatID, err := primitive.ObjectIDFromHex(chatIDParam)
+	tokens, err := e.startSession(ctx, r, user.ID)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	chat, err := e.ChatDAO.GetChatByID(ctx, chatID)
+	bytes, err := json.Marshal(tokens)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	var users []*users.User
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
 
-	for _, userID := range chat.Users {
-		user, err := e.UserDAO.GetUserByID(ctx, userID)
+// allowAttempt writes a 429 response and returns false if key is locked out.
+func (e *Endpoints) allowAttempt(w http.ResponseWriter, throttle *auth.Throttle, key string) bool {
+	ok, retryAfter := throttle.Allow(key)
+	if ok {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+	e.handleError(w, errTooManyRequests)
+
+	return false
+}
+
+func parseLoginParams(r *http.Request) (*LoginParams, error) {
+	var params LoginParams
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		params.NickName = r.PostFormValue("nickName")
+		params.Password = r.PostFormValue("password")
+	default:
+		err := json.NewDecoder(r.Body).Decode(&params)
 		if err != nil {
-			e.handleError(w, err)
-			return
+			return nil, err
 		}
+	}
 
-		users = append(users, user)
+	if params.NickName == "" || params.Password == "" {
+		return nil, users.ErrInvalidCredentials
 	}
 
-	bytes, err := json.Marshal(users)
+	return &params, nil
+}
+
+// clientIP returns the address of the peer. Forwarding headers are not
+// trusted since they are set by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// startSession creates a session for the user and issues the first pair of
+// access and refresh tokens for it.
+func (e *Endpoints) startSession(ctx context.Context, r *http.Request, userID primitive.ObjectID) (*TokenParams, error) {
+	sessionID := primitive.NewObjectID()
+	tokens, refreshHash, err := e.issueTokens(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &sessions.Session{
+		ID:          sessionID,
+		UserID:      userID,
+		RefreshHash: refreshHash,
+		UserAgent:   r.UserAgent(),
+		CreatedAt:   time.Now().UnixNano(),
+		ExpiresAt:   time.Now().Add(RefreshTokenTTL),
+	}
+
+	err = e.SessionDAO.AddSession(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (e *Endpoints) issueTokens(userID, sessionID primitive.ObjectID) (*TokenParams, []byte, error) {
+	token, err := auth.CreateToken(userID, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, refreshHash, err := sessions.NewRefreshToken(sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens := &TokenParams{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL / time.Second),
+	}
+
+	return tokens, refreshHash, nil
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token and a
+// new refresh token. Presenting a refresh token that was already exchanged
+// means it was stolen or replayed, so the whole session is revoked.
+func (e *Endpoints) RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(200)
+		return
+	}
+	ctx := context.Background()
+
+	var params RefreshTokenParams
+	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	w.WriteHeader(200)
-	w.Write(bytes)
-}
-func (e *Endpoints) GetMe(w http.ResponseWriter, r *http.Request) {
-	userID, err := e.getUserIDFromToken(r)
+	sessionID, hash, err := sessions.ParseRefreshToken(params.RefreshToken)
 	if err != nil {
-		e.handleError(w, errors.New("unauthorized"))
+		e.handleError(w, errUnauthorized)
 		return
 	}
 
-	user, err := e.UserDAO.GetUserByID(context.Background(), userID)
-	bytes, err := json.Marshal(user)
+	session, err := e.SessionDAO.GetSessionByID(ctx, sessionID)
+	if err == sessions.ErrNotFound {
+		e.handleError(w, errUnauthorized)
+		return
+	}
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	w.WriteHeader(200)
-	w.Write(bytes)
+	if !session.Active() {
+		e.handleError(w, errUnauthorized)
+		return
+	}
 
-}
-func (e *Endpoints) GetTokenHandler(w http.ResponseWriter, r *http.Request) {
-	e.writeHeaders(w)
+	if subtle.ConstantTimeCompare(hash, session.PreviousHash) == 1 {
+		log.Printf("Refresh token reuse detected, revoking session %s", session.ID.Hex())
+		err = e.SessionDAO.Revoke(ctx, session.ID)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+		e.handleError(w, errUnauthorized)
+		return
+	}
 
-	nickname := r.URL.Query().Get("nickname")
-	password := r.URL.Query().Get("password")
+	if subtle.ConstantTimeCompare(hash, session.RefreshHash) != 1 {
+		e.handleError(w, errUnauthorized)
+		return
+	}
+
+	tokens, refreshHash, err := e.issueTokens(session.UserID, session.ID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
 
-	user, err := e.UserDAO.GetUserByNickname(context.TODO(), nickname)
+	err = e.SessionDAO.Rotate(ctx, session.ID, hash, refreshHash, time.Now().Add(RefreshTokenTTL))
+	if err == sessions.ErrStaleToken {
+		e.handleError(w, errUnauthorized)
+		return
+	}
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	if strings.Compare(password, user.Password) != 0 {
-		e.handleError(w, errors.New("unauthorized"))
+	bytes, err := json.Marshal(tokens)
+	if err != nil {
+		e.handleError(w, err)
 		return
 	}
 
-	token, err := auth.CreateToken(user.ID)
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// LogoutHandler revokes the session of the presented access token, or every
+// session of the user with ?all=true.
+func (e *Endpoints) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		err = e.SessionDAO.RevokeAllByUser(ctx, userIDFromContext(r.Context()))
+	} else {
+		err = e.SessionDAO.Revoke(ctx, sessionIDFromContext(r.Context()))
+	}
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	tokenStruct := &TokenParams{Token: token}
+	w.WriteHeader(200)
+}
+
+func (e *Endpoints) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	w.Header().Set("Cache-Control", "public, max-age=300")
 
-	bytes, err := json.Marshal(tokenStruct)
+	bytes, err := json.Marshal(auth.JWKS())
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
+	w.WriteHeader(200)
 	w.Write(bytes)
 }
 
@@ -254,28 +453,139 @@ func (e *Endpoints) Middleware(h http.Handler) http.Handler {
 			w.WriteHeader(200)
 		}
 
-		_, err := e.getUserIDFromToken(r)
+		claims, err := e.getClaimsFromToken(r)
 		if err != nil {
 			e.handleError(w, err)
 			return
 		}
-		h.ServeHTTP(w, r)
+
+		userID, err := claims.User()
+		if err != nil {
+			e.handleError(w, errUnauthorized)
+			return
+		}
+
+		sessionID, err := claims.Session()
+		if err != nil {
+			e.handleError(w, errUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userIDKey, userID)
+		ctx = context.WithValue(ctx, sessionIDKey, sessionID)
+		h.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (e *Endpoints) getUserIDFromToken(r *http.Request) (primitive.ObjectID, error) {
+type contextKey int
+
+const (
+	userIDKey contextKey = iota
+	sessionIDKey
+)
+
+// userIDFromContext returns the authenticated caller set by Middleware.
+func userIDFromContext(ctx context.Context) primitive.ObjectID {
+	userID, _ := ctx.Value(userIDKey).(primitive.ObjectID)
+	return userID
+}
+
+func sessionIDFromContext(ctx context.Context) primitive.ObjectID {
+	sessionID, _ := ctx.Value(sessionIDKey).(primitive.ObjectID)
+	return sessionID
+}
+
+// authorizeChat returns the chat if userID is one of its members. Missing
+// chats are reported as forbidden too so that IDs cannot be probed.
+func (e *Endpoints) authorizeChat(ctx context.Context, userID, chatID primitive.ObjectID) (*chats.Chat, error) {
+	chat, err := e.ChatDAO.GetChatByID(ctx, chatID)
+	if err == chats.ErrNotFound {
+		return nil, errForbidden
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !chat.HasUser(userID) {
+		return nil, errForbidden
+	}
+
+	return chat, nil
+}
+
+// authorizeAttachment allows the uploader and members of any chat the
+// attachment was sent to.
+func (e *Endpoints) authorizeAttachment(ctx context.Context, userID, attachmentID primitive.ObjectID) error {
+	att, err := e.AttachmentDAO.GetAttachmentInfo(ctx, attachmentID)
+	if err == storage.ErrNotFound {
+		return errForbidden
+	}
+	if err != nil {
+		return err
+	}
+
+	if att.Owner == userID {
+		return nil
+	}
+
+	chatIDs, err := e.MessageDAO.GetChatIDsByAttachment(ctx, attachmentID)
+	if err != nil {
+		return err
+	}
+
+	for _, chatID := range chatIDs {
+		_, err := e.authorizeChat(ctx, userID, chatID)
+		if err == nil {
+			return nil
+		}
+		if err != errForbidden {
+			return err
+		}
+	}
+
+	return errForbidden
+}
+
+// getClaimsFromToken validates the bearer token and makes sure its session
+// has not been revoked.
+func (e *Endpoints) getClaimsFromToken(r *http.Request) (*auth.Claims, error) {
 	authHeader := r.Header.Get("Authorization")
 
 	if authHeader == "" {
-		return primitive.ObjectID{}, errors.New("unauthorized")
+		return nil, errUnauthorized
 	}
 
 	headerParts := strings.Split(authHeader, " ")
 	if len(headerParts) != 2 {
-		return primitive.ObjectID{}, errors.New("unauthorized")
+		return nil, errUnauthorized
+	}
+
+	return e.validateToken(r.Context(), headerParts[1])
+}
+
+// validateToken checks the token signature and expiry and makes sure its
+// session is still active.
+func (e *Endpoints) validateToken(ctx context.Context, token string) (*auth.Claims, error) {
+	claims, err := auth.ParseToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errUnauthorized, err)
+	}
+
+	sessionID, err := claims.Session()
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	active, err := e.SessionDAO.IsActive(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !active {
+		return nil, fmt.Errorf("%w: session revoked", errUnauthorized)
 	}
 
-	return auth.CheckToken(headerParts[1])
+	return claims, nil
 }
 
 func (e *Endpoints) writeHeaders(w http.ResponseWriter) {
@@ -291,10 +601,31 @@ type AddChatParams struct {
 }
 
 type AddMessageParams struct {
-	FromID         string                   `json:"fromID"`
+	// FromID is optional, messages are always sent on behalf of the caller.
+	FromID         string                   `json:"fromID,omitempty"`
 	ChatID         string                   `json:"chatID"`
 	Text           string                   `json:"text"`
 	AttachmentLink *messages.AttachmentLink `json:"attachmentLink,omitempty"`
+	// ClientMsgID makes sending idempotent: a retry with the same ID returns
+	// the message stored by the first attempt.
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+	// Poll makes the message a poll, Text and AttachmentLink must be empty.
+	Poll *PollParams `json:"poll,omitempty"`
+	// SendAt schedules the message for a later time, in unix nanoseconds.
+	SendAt int64 `json:"sendAt,omitempty"`
+	// ExpiresAfter deletes the message for everyone that many seconds after
+	// it was sent.
+	ExpiresAfter int64 `json:"expiresAfter,omitempty"`
+	// ReplyTo is a message of the same chat, Quote an optional part of its
+	// text.
+	ReplyTo string `json:"replyTo,omitempty"`
+	Quote   string `json:"quote,omitempty"`
+	// ForwardFrom is a message of any chat of the caller whose content is
+	// sent again. Text and AttachmentLink must be empty.
+	ForwardFrom string `json:"forwardFrom,omitempty"`
+	// ThreadRootID posts the message as a reply in the thread started by a
+	// message of the main timeline.
+	ThreadRootID string `json:"threadRootId,omitempty"`
 }
 
 func (e *Endpoints) AddMessageHandler(w http.ResponseWriter, r *http.Request) {
@@ -306,34 +637,1297 @@ func (e *Endpoints) AddMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fromID, err := primitive.ObjectIDFromHex(params.FromID)
+	msg, err := e.createMessage(context.Background(), userIDFromContext(r.Context()), &params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+const (
+	maxClientMsgIDLength = 64
+
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// maxExpiresAfter is a week, in seconds.
+	maxExpiresAfter = 7 * 24 * 60 * 60
+)
+
+// createMessage stores a message sent by fromID and broadcasts it to the
+// chat. It is shared by the REST and the websocket API. A retry with a known
+// client message ID returns the stored message without broadcasting it again.
+func (e *Endpoints) createMessage(ctx context.Context, fromID primitive.ObjectID, params *AddMessageParams) (*messages.Message, error) {
+	if params.FromID != "" && params.FromID != fromID.Hex() {
+		return nil, errForbidden
+	}
+
+	chatID, err := primitive.ObjectIDFromHex(params.ChatID)
+	if err != nil {
+		return nil, err
+	}
+
+	chat, err := e.authorizeChat(ctx, fromID, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(params.ClientMsgID) > maxClientMsgIDLength {
+		return nil, fmt.Errorf("%w: clientMsgId is longer than %d", errBadRequest, maxClientMsgIDLength)
+	}
+
+	if params.ExpiresAfter < 0 || params.ExpiresAfter > maxExpiresAfter {
+		return nil, fmt.Errorf("%w: expiresAfter must be between 0 and %d", errBadRequest, maxExpiresAfter)
+	}
+
+	now := time.Now()
+	if params.SendAt != 0 {
+		sendAt := time.Unix(0, params.SendAt)
+		if !sendAt.After(now) || sendAt.Sub(now) > maxScheduleAhead {
+			return nil, fmt.Errorf("%w: sendAt must be in the next %s", errBadRequest, maxScheduleAhead)
+		}
+	}
+
+	if params.ClientMsgID != "" {
+		msg, err := e.MessageDAO.GetMessageByClientID(ctx, chatID, fromID, params.ClientMsgID)
+		if err == nil {
+			msg.AggregateStatus()
+			return msg, nil
+		}
+		if err != messages.ErrNotFound {
+			return nil, err
+		}
+	}
+
+	if params.AttachmentLink != nil {
+		err = e.authorizeAttachment(ctx, fromID, params.AttachmentLink.AttachmentID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	text, entities, err := e.parseText(ctx, params.Text)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &messages.Message{
+		ID:             primitive.NewObjectID(),
+		From:           fromID,
+		ChatID:         chatID,
+		Text:           text,
+		Entities:       entities,
+		Time:           now.UnixNano(),
+		AttachmentLink: params.AttachmentLink,
+		ClientMsgID:    params.ClientMsgID,
+		ExpiresAfter:   params.ExpiresAfter,
+	}
+
+	for _, userID := range chat.Users {
+		if userID != fromID {
+			msg.Deliveries = append(msg.Deliveries, &messages.Delivery{
+				UserID: userID,
+				State:  messages.StatusSent,
+				Time:   msg.Time,
+			})
+		}
+	}
+	msg.AggregateStatus()
+
+	if params.ThreadRootID != "" {
+		err = e.setThread(ctx, msg, params.ThreadRootID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.ReplyTo != "" {
+		err = e.setReply(ctx, msg, params.ReplyTo, params.Quote)
+		if err != nil {
+			return nil, err
+		}
+	} else if params.Quote != "" {
+		return nil, fmt.Errorf("%w: quote without replyTo", errBadRequest)
+	}
+
+	if params.Poll != nil {
+		if params.Text != "" || params.AttachmentLink != nil || params.ForwardFrom != "" {
+			return nil, fmt.Errorf("%w: polls cannot have other content", errBadRequest)
+		}
+
+		// A scheduled poll has to stay open past its sending.
+		sentAt := now
+		if params.SendAt != 0 {
+			sentAt = time.Unix(0, params.SendAt)
+		}
+
+		msg.Poll, err = newPoll(params.Poll, sentAt)
+		if err != nil {
+			return nil, err
+		}
+		msg.Text = msg.Poll.Question
+	}
+
+	if params.ForwardFrom != "" {
+		if params.Text != "" || params.AttachmentLink != nil {
+			return nil, fmt.Errorf("%w: forwarded messages cannot have own content", errBadRequest)
+		}
+
+		err = e.setForward(ctx, msg, params.ForwardFrom)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if params.SendAt != 0 {
+		msg.ScheduledAt = msg.Time
+		msg.Time = params.SendAt
+
+		_, err = e.MessageDAO.ScheduleMessage(ctx, msg, params.SendAt)
+		if err == messages.ErrDuplicate {
+			// A concurrent retry scheduled it first.
+			msg, err = e.MessageDAO.GetMessageByClientID(ctx, chatID, fromID, params.ClientMsgID)
+			if err != nil {
+				return nil, err
+			}
+			msg.AggregateStatus()
+			return msg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e.discardDraft(ctx, msg, params.Text)
+
+		return msg, nil
+	}
+
+	err = e.sendMessage(ctx, msg)
+	if err == messages.ErrDuplicate {
+		// A concurrent retry stored it first and has broadcast it.
+		msg, err = e.MessageDAO.GetMessageByClientID(ctx, chatID, fromID, params.ClientMsgID)
+		if err != nil {
+			return nil, err
+		}
+		msg.AggregateStatus()
+		return msg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	e.discardDraft(ctx, msg, params.Text)
+
+	return msg, nil
+}
+
+// sendMessage stores a prepared message and broadcasts it.
+func (e *Endpoints) sendMessage(ctx context.Context, msg *messages.Message) error {
+	if msg.ExpiresAfter > 0 {
+		msg.ExpiresAt = msg.Time + msg.ExpiresAfter*int64(time.Second)
+	}
+
+	err := e.MessageDAO.AddMessage(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	if msg.Poll != nil {
+		msg.Poll.Tally(primitive.NilObjectID)
+	}
+
+	e.msgChannel <- msg
+
+	if msg.ThreadRootID != nil {
+		e.updateThread(ctx, msg)
+	}
+
+	e.notifyMentions(ctx, msg)
+
+	if msg.LinkPreview == nil {
+		go e.fetchLinkPreview(msg)
+	}
+
+	return nil
+}
+
+// parseText turns the text sent by a client into plain text and entities,
+// resolving mentions. Mentions of unknown nicknames are dropped.
+func (e *Endpoints) parseText(ctx context.Context, raw string) (string, []*messages.Entity, error) {
+	text, parsed := messages.ParseText(raw)
+
+	var nicknames []string
+	seen := make(map[string]bool)
+	for _, entity := range parsed {
+		if entity.Type == messages.EntityMention && !seen[entity.Nickname] && len(nicknames) < maxMentions {
+			seen[entity.Nickname] = true
+			nicknames = append(nicknames, entity.Nickname)
+		}
+	}
+
+	byNickname := make(map[string]primitive.ObjectID)
+	if len(nicknames) > 0 {
+		found, err := e.UserDAO.GetUsersByNicknames(ctx, nicknames)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, user := range found {
+			byNickname[user.NickName] = user.ID
+		}
+	}
+
+	// Unknown nicknames, and those past maxMentions, stay plain text.
+	var entities []*messages.Entity
+	for _, entity := range parsed {
+		if entity.Type == messages.EntityMention {
+			userID, ok := byNickname[entity.Nickname]
+			if !ok {
+				continue
+			}
+			entity.UserID = &userID
+		}
+		entities = append(entities, entity)
+	}
+
+	return text, entities, nil
+}
+
+type MentionPayload struct {
+	MessageID primitive.ObjectID `json:"messageId"`
+	ChatID    primitive.ObjectID `json:"chatId"`
+	From      primitive.ObjectID `json:"from"`
+}
+
+// notifyMentions tells the members of the chat mentioned in msg. Users
+// outside the chat cannot read it and are not notified.
+func (e *Endpoints) notifyMentions(ctx context.Context, msg *messages.Message) {
+	mentions := msg.Mentions()
+	if len(mentions) == 0 {
+		return
+	}
+
+	chat, err := e.ChatDAO.GetChatByID(ctx, msg.ChatID)
+	if err != nil {
+		log.Printf("Mention error: %s", err)
+		return
+	}
+
+	var recipients []primitive.ObjectID
+	for _, userID := range mentions {
+		if userID != msg.From && chat.HasUser(userID) {
+			recipients = append(recipients, userID)
+		}
+	}
+
+	err = e.hub.Publish(recipients, hub.EventMention, &MentionPayload{
+		MessageID: msg.ID,
+		ChatID:    msg.ChatID,
+		From:      msg.From,
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+const linkPreviewTimeout = 15 * time.Second
+
+// maxMentions caps the distinct users mentioned by one message.
+const maxMentions = 50
+
+// fetchLinkPreview adds the preview of the first link to msg and sends the
+// chat the updated message.
+func (e *Endpoints) fetchLinkPreview(msg *messages.Message) {
+	link := msg.FirstURL()
+	if e.LinkPreviews == nil || link == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+
+	preview, err := e.LinkPreviews.Fetch(ctx, link)
+	if err == linkpreview.ErrNoPreview {
+		return
+	}
+	if err != nil {
+		log.Printf("Link preview error: %s", err)
+		return
+	}
+
+	updated, err := e.MessageDAO.SetLinkPreview(ctx, msg.ID, link, preview)
+	if err == messages.ErrConflict {
+		// Deleted, or edited to another link, meanwhile.
+		return
+	}
+	if err != nil {
+		log.Printf("Link preview error: %s", err)
+		return
+	}
+
+	err = e.hub.PublishToChat(updated.ChatID, hub.EventMessageUpdated, updated)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+type ThreadUpdatedPayload struct {
+	RootID      primitive.ObjectID `json:"rootId"`
+	ChatID      primitive.ObjectID `json:"chatId"`
+	ReplyCount  int                `json:"replyCount"`
+	LastReplyAt int64              `json:"lastReplyAt"`
+}
+
+// setThread posts msg in the thread started by a message of its chat.
+// Threads do not nest, so the root has to be on the main timeline.
+func (e *Endpoints) setThread(ctx context.Context, msg *messages.Message, threadRootID string) error {
+	rootID, err := primitive.ObjectIDFromHex(threadRootID)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	root, err := e.MessageDAO.GetMessageByID(ctx, rootID)
+	if err == messages.ErrNotFound || (err == nil && root.ChatID != msg.ChatID) {
+		return fmt.Errorf("%w: threadRootId is not a message of this chat", errBadRequest)
+	}
+	if err != nil {
+		return err
+	}
+
+	if root.ThreadRootID != nil {
+		return fmt.Errorf("%w: threads cannot be started from thread replies", errBadRequest)
+	}
+
+	if root.Deleted {
+		return fmt.Errorf("%w: cannot reply in the thread of a deleted message", errBadRequest)
+	}
+
+	msg.ThreadRootID = &root.ID
+
+	return nil
+}
+
+// updateThread counts the reply on its root and tells the chat. The reply
+// is already stored, so failures are only logged.
+func (e *Endpoints) updateThread(ctx context.Context, reply *messages.Message) {
+	root, err := e.MessageDAO.AddThreadReply(ctx, *reply.ThreadRootID, reply.Time)
+	if err != nil {
+		log.Printf("Thread update error: %s", err)
+		return
+	}
+
+	e.publishThread(root)
+}
+
+func (e *Endpoints) publishThread(root *messages.Message) {
+	err := e.hub.PublishToChat(root.ChatID, hub.EventThreadUpdated, &ThreadUpdatedPayload{
+		RootID:      root.ID,
+		ChatID:      root.ChatID,
+		ReplyCount:  root.ThreadReplyCount,
+		LastReplyAt: root.ThreadLastReplyAt,
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+// setReply makes msg a reply to another message of its chat, quoting the
+// given part of it.
+func (e *Endpoints) setReply(ctx context.Context, msg *messages.Message, replyTo, quote string) error {
+	replyID, err := primitive.ObjectIDFromHex(replyTo)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	original, err := e.MessageDAO.GetMessageByID(ctx, replyID)
+	if err == messages.ErrNotFound || (err == nil && (original.ChatID != msg.ChatID || original.IsHiddenFor(msg.From))) {
+		return fmt.Errorf("%w: replyTo is not a message of this chat", errBadRequest)
+	}
+	if err != nil {
+		return err
+	}
+
+	if original.Deleted {
+		return fmt.Errorf("%w: cannot reply to a deleted message", errBadRequest)
+	}
+
+	// Replies stay within their timeline: the main one, or a thread where
+	// the root can be replied to as well.
+	sameTimeline := (original.ThreadRootID == nil && msg.ThreadRootID == nil) ||
+		(original.ThreadRootID != nil && msg.ThreadRootID != nil && *original.ThreadRootID == *msg.ThreadRootID) ||
+		(msg.ThreadRootID != nil && original.ID == *msg.ThreadRootID)
+	if !sameTimeline {
+		return fmt.Errorf("%w: replyTo is not a message of this thread", errBadRequest)
+	}
+
+	msg.ReplyTo = &original.ID
+	msg.ReplyPreview = messages.NewPreview(original)
+
+	if quote == "" {
+		return nil
+	}
+
+	// A quote would outlive a self-destructing message.
+	if original.ExpiresAt != 0 {
+		return fmt.Errorf("%w: self-destructing messages cannot be quoted", errBadRequest)
+	}
+
+	index := strings.Index(original.Text, quote)
+	if index < 0 {
+		return fmt.Errorf("%w: quote is not a part of the replied message", errBadRequest)
+	}
+
+	msg.Quote = &messages.Quote{
+		Text:   quote,
+		Offset: utf8.RuneCountInString(original.Text[:index]),
+		Length: utf8.RuneCountInString(quote),
+	}
+
+	return nil
+}
+
+// setForward copies the content of a message the sender can see into msg.
+func (e *Endpoints) setForward(ctx context.Context, msg *messages.Message, forwardFrom string) error {
+	original, err := e.authorizeMessage(ctx, msg.From, forwardFrom)
+	if err != nil {
+		return err
+	}
+
+	if original.Deleted {
+		return fmt.Errorf("%w: cannot forward a deleted message", errBadRequest)
+	}
+
+	if original.Poll != nil {
+		return fmt.Errorf("%w: polls cannot be forwarded", errBadRequest)
+	}
+
+	// A copy would outlive a self-destructing message.
+	if original.ExpiresAt != 0 {
+		return fmt.Errorf("%w: self-destructing messages cannot be forwarded", errBadRequest)
+	}
+
+	msg.Text = original.Text
+	msg.Entities = original.Entities
+	msg.LinkPreview = original.LinkPreview
+	msg.AttachmentLink = original.AttachmentLink
+	msg.ForwardedFrom = original.ForwardedFrom
+	if msg.ForwardedFrom == nil {
+		msg.ForwardedFrom = &messages.ForwardInfo{
+			From:      original.From,
+			ChatID:    original.ChatID,
+			MessageID: original.ID,
+			Time:      original.Time,
+		}
+	}
+
+	return nil
+}
+
+// prepareMessages fills in what messages show to viewer but is not stored
+// as is: previews of replied messages, reaction counts, delivery status and
+// poll results.
+func (e *Endpoints) prepareMessages(ctx context.Context, viewer primitive.ObjectID, msgs []*messages.Message) error {
+	for _, msg := range msgs {
+		msg.CountReactions(viewer)
+		msg.AggregateStatus()
+		if msg.Poll != nil {
+			msg.Poll.Tally(viewer)
+		}
+	}
+
+	return e.attachPreviews(ctx, msgs)
+}
+
+// attachPreviews embeds previews of the replied messages.
+func (e *Endpoints) attachPreviews(ctx context.Context, msgs []*messages.Message) error {
+	var ids []primitive.ObjectID
+	for _, msg := range msgs {
+		if msg.ReplyTo != nil {
+			ids = append(ids, *msg.ReplyTo)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	replied, err := e.MessageDAO.GetMessagesByIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	previews := make(map[primitive.ObjectID]*messages.Preview)
+	for _, msg := range replied {
+		previews[msg.ID] = messages.NewPreview(msg)
+	}
+
+	for _, msg := range msgs {
+		if msg.ReplyTo != nil {
+			msg.ReplyPreview = previews[*msg.ReplyTo]
+		}
+	}
+
+	return nil
+}
+
+type EditMessageParams struct {
+	MessageID string `json:"messageId"`
+	Text      string `json:"text"`
+}
+
+type DeleteMessageParams struct {
+	MessageID   string `json:"messageId"`
+	ForEveryone bool   `json:"forEveryone"`
+}
+
+type MessageDeletedPayload struct {
+	ID           primitive.ObjectID  `json:"id"`
+	ChatID       primitive.ObjectID  `json:"chatId"`
+	ThreadRootID *primitive.ObjectID `json:"threadRootId,omitempty"`
+	ForEveryone  bool                `json:"forEveryone"`
+}
+
+// EditMessageHandler lets the author change the text of a message. The
+// previous text is kept in the message's revisions.
+func (e *Endpoints) EditMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params EditMessageParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	msg, err := e.authorizeMessage(ctx, userID, params.MessageID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	if msg.From != userID {
+		e.handleError(w, errForbidden)
+		return
+	}
+
+	if msg.Deleted {
+		e.handleError(w, fmt.Errorf("%w: message is deleted", errBadRequest))
+		return
+	}
+
+	if msg.Poll != nil {
+		e.handleError(w, fmt.Errorf("%w: polls cannot be edited", errBadRequest))
+		return
+	}
+
+	if params.Text == "" && msg.AttachmentLink == nil {
+		e.handleError(w, fmt.Errorf("%w: text is empty", errBadRequest))
+		return
+	}
+
+	text, entities, err := e.parseText(ctx, params.Text)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	msg, err = e.MessageDAO.EditMessage(ctx, msg, text, entities)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	go e.fetchLinkPreview(msg)
+
+	err = e.hub.PublishToChat(msg.ChatID, hub.EventMessageUpdated, msg)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// DeleteMessageHandler deletes a message for the caller only, or for every
+// member of the chat if the caller is its author and forEveryone is set.
+func (e *Endpoints) DeleteMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params DeleteMessageParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	msg, err := e.authorizeMessage(ctx, userID, params.MessageID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	payload := &MessageDeletedPayload{
+		ID:           msg.ID,
+		ChatID:       msg.ChatID,
+		ThreadRootID: msg.ThreadRootID,
+		ForEveryone:  params.ForEveryone,
+	}
+
+	if params.ForEveryone {
+		if msg.From != userID {
+			e.handleError(w, errForbidden)
+			return
+		}
+
+		_, err = e.MessageDAO.DeleteMessage(ctx, msg.ID)
+		if err == messages.ErrConflict {
+			// Already deleted, nothing changes.
+			w.WriteHeader(200)
+			return
+		}
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+
+		e.messageTombstoned(ctx, msg, userID)
+
+		err = e.hub.PublishToChat(msg.ChatID, hub.EventMessageDeleted, payload)
+	} else {
+		err = e.MessageDAO.HideMessage(ctx, msg.ID, userID)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+
+		// Only the caller's other devices need to know.
+		err = e.hub.Publish([]primitive.ObjectID{userID}, hub.EventMessageDeleted, payload)
+	}
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+
+	w.WriteHeader(200)
+}
+
+type MarkReadParams struct {
+	ChatID string `json:"chatId"`
+	// MessageID defaults to the latest message of the chat.
+	MessageID string `json:"messageId,omitempty"`
+}
+
+// MarkReadHandler moves the caller's read marker in a chat forward and lets
+// the other members know. Marking an older message than the marker is a
+// no-op that returns the current marker.
+func (e *Endpoints) MarkReadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params MarkReadParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	chatID, err := primitive.ObjectIDFromHex(params.ChatID)
+	if err != nil {
+		e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+		return
+	}
+
+	_, err = e.authorizeChat(ctx, userID, chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	var msg *messages.Message
+	if params.MessageID != "" {
+		msg, err = e.authorizeMessage(ctx, userID, params.MessageID)
+		if err == nil && msg.ChatID != chatID {
+			err = fmt.Errorf("%w: message is not in this chat", errBadRequest)
+		}
+		// The marker tracks the main timeline, where replies are not.
+		if err == nil && msg.ThreadRootID != nil {
+			err = fmt.Errorf("%w: thread replies do not move the read marker", errBadRequest)
+		}
+	} else {
+		msg, err = e.MessageDAO.GetLatestMessage(ctx, chatID, userID)
+		if err == nil && msg == nil {
+			err = fmt.Errorf("%w: chat is empty", errBadRequest)
+		}
+	}
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	advanced := true
+	marker, err := e.ReceiptDAO.MarkRead(ctx, userID, chatID, msg.ID, msg.Time)
+	if err == receipts.ErrNotAdvanced {
+		advanced = false
+		marker, err = e.ReceiptDAO.GetMarker(ctx, userID, chatID)
+	}
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	if advanced {
+		err = e.hub.PublishToChat(chatID, hub.EventReadReceipt, marker)
+		if err != nil {
+			log.Printf("Websocket error: %s", err)
+		}
+
+		e.markReadUpTo(ctx, chatID, userID, marker.Time)
+	}
+
+	bytes, err := json.Marshal(marker)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// GetReadMarkers returns how far each member has read the chat, so that
+// clients can tell who has read which message.
+func (e *Endpoints) GetReadMarkers(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	ctx := context.TODO()
+
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chatId"))
+	if err != nil {
+		e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+		return
+	}
+
+	_, err = e.authorizeChat(ctx, userIDFromContext(r.Context()), chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	markers, err := e.ReceiptDAO.GetMarkersByChat(ctx, chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(markers)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+type PollParams struct {
+	Question       string   `json:"question"`
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multipleChoice"`
+	Anonymous      bool     `json:"anonymous"`
+	// ClosesAt closes the poll automatically, in unix nanoseconds.
+	ClosesAt int64 `json:"closesAt,omitempty"`
+}
+
+// newPoll validates a poll to be sent at sentAt.
+func newPoll(params *PollParams, sentAt time.Time) (*messages.Poll, error) {
+	question := strings.TrimSpace(params.Question)
+	if question == "" || utf8.RuneCountInString(question) > messages.MaxPollQuestionRunes {
+		return nil, fmt.Errorf("%w: poll question must have 1 to %d characters", errBadRequest, messages.MaxPollQuestionRunes)
+	}
+
+	if len(params.Options) < 2 || len(params.Options) > messages.MaxPollOptions {
+		return nil, fmt.Errorf("%w: polls have 2 to %d options", errBadRequest, messages.MaxPollOptions)
+	}
+
+	if params.ClosesAt != 0 && params.ClosesAt <= sentAt.UnixNano() {
+		return nil, fmt.Errorf("%w: closesAt must be after the poll is sent", errBadRequest)
+	}
+
+	poll := &messages.Poll{
+		Question:       question,
+		MultipleChoice: params.MultipleChoice,
+		Anonymous:      params.Anonymous,
+		ClosesAt:       params.ClosesAt,
+	}
+
+	seen := make(map[string]bool)
+	for _, text := range params.Options {
+		text = strings.TrimSpace(text)
+		if text == "" || utf8.RuneCountInString(text) > messages.MaxPollOptionRunes {
+			return nil, fmt.Errorf("%w: poll options must have 1 to %d characters", errBadRequest, messages.MaxPollOptionRunes)
+		}
+		if seen[text] {
+			return nil, fmt.Errorf("%w: duplicate poll option %q", errBadRequest, text)
+		}
+		seen[text] = true
+
+		poll.Options = append(poll.Options, &messages.PollOption{Text: text})
+	}
+
+	return poll, nil
+}
+
+type VoteParams struct {
+	MessageID string `json:"messageId"`
+	// Options are indexes of the chosen options, none retracts the vote.
+	Options []int `json:"options"`
+}
+
+type PollUpdatedPayload struct {
+	MessageID    primitive.ObjectID  `json:"messageId"`
+	ChatID       primitive.ObjectID  `json:"chatId"`
+	ThreadRootID *primitive.ObjectID `json:"threadRootId,omitempty"`
+	Poll         *messages.Poll      `json:"poll"`
+}
+
+// VoteHandler records the caller's vote in an open poll of one of their
+// chats and returns the poll message.
+func (e *Endpoints) VoteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params VoteParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	msg, err := e.authorizeMessage(ctx, userID, params.MessageID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	if msg.Poll == nil {
+		e.handleError(w, fmt.Errorf("%w: message is not a poll", errBadRequest))
+		return
+	}
+
+	err = msg.Poll.ValidateChoices(params.Options)
+	if err != nil {
+		e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+		return
+	}
+
+	msg, err = e.MessageDAO.Vote(ctx, msg.ID, userID, params.Options)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	e.pollUpdated(ctx, userID, w, msg)
+}
+
+type ClosePollParams struct {
+	MessageID string `json:"messageId"`
+}
+
+// ClosePollHandler lets the author close a poll before its close time. The
+// results are final from then on.
+func (e *Endpoints) ClosePollHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params ClosePollParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	msg, err := e.authorizeMessage(ctx, userID, params.MessageID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	if msg.Poll == nil {
+		e.handleError(w, fmt.Errorf("%w: message is not a poll", errBadRequest))
+		return
+	}
+
+	if msg.From != userID {
+		e.handleError(w, errForbidden)
+		return
+	}
+
+	msg, err = e.MessageDAO.ClosePoll(ctx, msg.ID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	e.pollUpdated(ctx, userID, w, msg)
+}
+
+// pollUpdated sends the new tally to the chat and the poll message, as seen
+// by the caller, back to them.
+func (e *Endpoints) pollUpdated(ctx context.Context, userID primitive.ObjectID, w http.ResponseWriter, msg *messages.Message) {
+	e.publishPoll(msg)
+
+	err := e.prepareMessages(ctx, userID, []*messages.Message{msg})
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+func (e *Endpoints) publishPoll(msg *messages.Message) {
+	msg.Poll.Tally(primitive.NilObjectID)
+
+	err := e.hub.PublishToChat(msg.ChatID, hub.EventPollUpdated, &PollUpdatedPayload{
+		MessageID:    msg.ID,
+		ChatID:       msg.ChatID,
+		ThreadRootID: msg.ThreadRootID,
+		Poll:         msg.Poll,
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+type PinParams struct {
+	MessageID string `json:"messageId"`
+}
+
+// PinUpdatedPayload tells that a message was pinned or unpinned. PinnedBy
+// and PinnedAt describe the pin, or the unpinning.
+type PinUpdatedPayload struct {
+	ChatID    primitive.ObjectID `json:"chatId"`
+	MessageID primitive.ObjectID `json:"messageId"`
+	Pinned    bool               `json:"pinned"`
+	PinnedBy  primitive.ObjectID `json:"pinnedBy"`
+	PinnedAt  int64              `json:"pinnedAt"`
+}
+
+func (e *Endpoints) PinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	e.pinHandler(w, r, true)
+}
+
+func (e *Endpoints) UnpinMessageHandler(w http.ResponseWriter, r *http.Request) {
+	e.pinHandler(w, r, false)
+}
+
+// pinHandler pins a message to the top of its chat or unpins it. Any member
+// may do both. It returns the pinned message IDs of the chat.
+func (e *Endpoints) pinHandler(w http.ResponseWriter, r *http.Request, pin bool) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params PinParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	msg, err := e.authorizeMessage(ctx, userID, params.MessageID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	payload := &PinUpdatedPayload{
+		ChatID:    msg.ChatID,
+		MessageID: msg.ID,
+		Pinned:    pin,
+		PinnedBy:  userID,
+		PinnedAt:  time.Now().UnixNano(),
+	}
+
+	var chat *chats.Chat
+	if pin {
+		if msg.Deleted {
+			e.handleError(w, fmt.Errorf("%w: message is deleted", errBadRequest))
+			return
+		}
+
+		chat, err = e.ChatDAO.PinMessage(ctx, msg.ChatID, &chats.Pin{
+			MessageID: msg.ID,
+			PinnedBy:  userID,
+			PinnedAt:  payload.PinnedAt,
+		})
+	} else {
+		chat, err = e.ChatDAO.UnpinMessage(ctx, msg.ChatID, msg.ID)
+	}
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	err = e.hub.PublishToChat(msg.ChatID, hub.EventPinUpdated, payload)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+
+	chat.FillPinnedMessageIDs()
+	bytes, err := json.Marshal(chat.PinnedMessageIDs)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// messageTombstoned cleans up after a message deleted for everyone, by its
+// author or once it expired: a reply no longer counts in its thread and the
+// pin of the message goes away.
+func (e *Endpoints) messageTombstoned(ctx context.Context, msg *messages.Message, by primitive.ObjectID) {
+	if msg.ThreadRootID != nil {
+		root, err := e.MessageDAO.RemoveThreadReply(ctx, *msg.ThreadRootID)
+		if err == nil {
+			e.publishThread(root)
+		} else if err != messages.ErrConflict {
+			log.Printf("Thread update error: %s", err)
+		}
+	}
+
+	_, err := e.ChatDAO.UnpinMessage(ctx, msg.ChatID, msg.ID)
+	if err == chats.ErrNotPinned {
+		return
+	}
+	if err != nil {
+		log.Printf("Pin error: %s", err)
+		return
+	}
+
+	err = e.hub.PublishToChat(msg.ChatID, hub.EventPinUpdated, &PinUpdatedPayload{
+		ChatID:    msg.ChatID,
+		MessageID: msg.ID,
+		Pinned:    false,
+		PinnedBy:  by,
+		PinnedAt:  time.Now().UnixNano(),
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+// PinnedMessage is a pinned message along with its pin.
+type PinnedMessage struct {
+	*chats.Pin
+	Message *messages.Message `json:"message"`
+}
+
+// GetPinned lists the pinned messages of a chat, latest pin first. Messages
+// deleted since they were pinned are left out.
+func (e *Endpoints) GetPinned(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	ctx := context.TODO()
+	userID := userIDFromContext(r.Context())
+
+	chatID, err := primitive.ObjectIDFromHex(r.URL.Query().Get("chatId"))
+	if err != nil {
+		e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+		return
+	}
+
+	chat, err := e.authorizeChat(ctx, userID, chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	result := []*PinnedMessage{}
+	if len(chat.Pins) > 0 {
+		ids := make([]primitive.ObjectID, 0, len(chat.Pins))
+		for _, pin := range chat.Pins {
+			ids = append(ids, pin.MessageID)
+		}
+
+		found, err := e.MessageDAO.GetMessagesByIDs(ctx, ids)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+
+		byID := make(map[primitive.ObjectID]*messages.Message)
+		for _, msg := range found {
+			if !msg.Deleted && !msg.IsHiddenFor(userID) {
+				byID[msg.ID] = msg
+			}
+		}
+
+		var msgs []*messages.Message
+		for i := len(chat.Pins) - 1; i >= 0; i-- {
+			pin := chat.Pins[i]
+			if msg, ok := byID[pin.MessageID]; ok {
+				result = append(result, &PinnedMessage{Pin: pin, Message: msg})
+				msgs = append(msgs, msg)
+			}
+		}
+
+		err = e.prepareMessages(ctx, userID, msgs)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+type ReactionParams struct {
+	MessageID string `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+// ReactionUpdatedPayload tells that UserID added or removed a reaction.
+// Count is the number of users reacting with Emoji afterwards.
+type ReactionUpdatedPayload struct {
+	MessageID    primitive.ObjectID  `json:"messageId"`
+	ChatID       primitive.ObjectID  `json:"chatId"`
+	ThreadRootID *primitive.ObjectID `json:"threadRootId,omitempty"`
+	UserID       primitive.ObjectID  `json:"userId"`
+	Emoji        string              `json:"emoji"`
+	Added        bool                `json:"added"`
+	Count        int                 `json:"count"`
+}
+
+func (e *Endpoints) AddReactionHandler(w http.ResponseWriter, r *http.Request) {
+	e.reactionHandler(w, r, true)
+}
+
+func (e *Endpoints) RemoveReactionHandler(w http.ResponseWriter, r *http.Request) {
+	e.reactionHandler(w, r, false)
+}
+
+// reactionHandler adds or removes the caller's reaction to a message of one
+// of their chats and returns the message with updated counts.
+func (e *Endpoints) reactionHandler(w http.ResponseWriter, r *http.Request, add bool) {
+	ctx := context.Background()
+	userID := userIDFromContext(r.Context())
+
+	var params ReactionParams
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	err = messages.ValidateEmoji(params.Emoji)
+	if err != nil {
+		e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+		return
+	}
+
+	msg, err := e.authorizeMessage(ctx, userID, params.MessageID)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	chatID, err := primitive.ObjectIDFromHex(params.ChatID)
+	if msg.Deleted {
+		e.handleError(w, fmt.Errorf("%w: message is deleted", errBadRequest))
+		return
+	}
+
+	if add {
+		msg, err = e.MessageDAO.AddReaction(ctx, msg.ID, params.Emoji, userID)
+	} else {
+		msg, err = e.MessageDAO.RemoveReaction(ctx, msg.ID, params.Emoji, userID)
+	}
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	msg := &messages.Message{
-		ID:             primitive.NewObjectID(),
-		From:           fromID,
-		ChatID:         chatID,
-		Text:           params.Text,
-		Time:           time.Now().UnixNano(),
-		AttachmentLink: params.AttachmentLink,
+	err = e.hub.PublishToChat(msg.ChatID, hub.EventReactionUpdated, &ReactionUpdatedPayload{
+		MessageID:    msg.ID,
+		ChatID:       msg.ChatID,
+		ThreadRootID: msg.ThreadRootID,
+		UserID:       userID,
+		Emoji:        params.Emoji,
+		Added:        add,
+		Count:        len(msg.Reactions[params.Emoji]),
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
 	}
 
-	err = e.MessageDAO.AddMessage(context.Background(), msg)
+	err = e.prepareMessages(ctx, userID, []*messages.Message{msg})
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	e.msgChannel <- msg
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// authorizeMessage returns the message if userID is a member of its chat and
+// has not deleted it for themselves.
+func (e *Endpoints) authorizeMessage(ctx context.Context, userID primitive.ObjectID, id string) (*messages.Message, error) {
+	msgID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	msg, err := e.MessageDAO.GetMessageByID(ctx, msgID)
+	if err == messages.ErrNotFound {
+		return nil, errForbidden
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.IsHiddenFor(userID) {
+		return nil, errForbidden
+	}
+
+	_, err = e.authorizeChat(ctx, userID, msg.ChatID)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
 }
 
 func (e *Endpoints) AddChatHandler(w http.ResponseWriter, r *http.Request) {
@@ -361,6 +1955,12 @@ func (e *Endpoints) AddChatHandler(w http.ResponseWriter, r *http.Request) {
 		Name:            params.Name,
 	}
 
+	// The creator is always a member of the chat.
+	callerID := userIDFromContext(r.Context())
+	if !chat.HasUser(callerID) {
+		chat.Users = append(chat.Users, callerID)
+	}
+
 	err = e.ChatDAO.AddChat(context.Background(), chat)
 	if err != nil {
 		e.handleError(w, err)
@@ -384,6 +1984,7 @@ func (e *Endpoints) UploadAttachmentHandler(w http.ResponseWriter, r *http.Reque
 
 	att := &storage.Attachment{
 		ID:      primitive.NewObjectID(),
+		Owner:   userIDFromContext(r.Context()),
 		Content: bytes,
 	}
 
@@ -414,6 +2015,12 @@ func (e *Endpoints) GetAttachmentHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = e.authorizeAttachment(ctx, userIDFromContext(r.Context()), attID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
 	att, err := e.AttachmentDAO.GetAttachmentByID(ctx, attID)
 	if err != nil {
 		e.handleError(w, err)
@@ -470,31 +2077,52 @@ func (e *Endpoints) GetUserByIDHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// ChatView is a chat as listed to one of its members, along with their
+// draft in it.
+type ChatView struct {
+	*chats.Chat
+	Draft *drafts.Draft `json:"draft,omitempty"`
+}
+
 func (e *Endpoints) GetChatsByUser(w http.ResponseWriter, r *http.Request) {
 	e.writeHeaders(w)
 	ctx := context.TODO()
-	id := r.URL.Query().Get("userId")
-	userID, err := primitive.ObjectIDFromHex(id)
+	userID := userIDFromContext(r.Context())
+
+	// userId is kept for compatibility but may only name the caller.
+	if id := r.URL.Query().Get("userId"); id != "" && id != userID.Hex() {
+		e.handleError(w, errForbidden)
+		return
+	}
+
+	chats, err := e.ChatDAO.GetChatsByUser(ctx, userID)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	chats, err := e.ChatDAO.GetChatsByUser(ctx, userID)
+	userDrafts, err := e.DraftDAO.GetDraftsByUser(ctx, userID)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
+	draftsByChat := make(map[primitive.ObjectID]*drafts.Draft, len(userDrafts))
+	for _, draft := range userDrafts {
+		draftsByChat[draft.ChatID] = draft
+	}
+
+	views := make([]*ChatView, 0, len(chats))
 	for i := 0; i < len(chats); i++ {
-		chats[i], err = e.enrichChat(ctx, chats[i])
+		chats[i], err = e.enrichChat(ctx, chats[i], userID)
 		if err != nil {
 			e.handleError(w, err)
 			return
 		}
+		views = append(views, &ChatView{Chat: chats[i], Draft: draftsByChat[chats[i].ID]})
 	}
 
-	bytes, err := json.Marshal(chats)
+	bytes, err := json.Marshal(views)
 	if err != nil {
 		e.handleError(w, err)
 		return
@@ -515,25 +2143,123 @@ func (e *Endpoints) GetMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	_, err = e.authorizeChat(ctx, userIDFromContext(r.Context()), chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	query, err := e.parsePageQuery(ctx, r, chatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	page, err := e.MessageDAO.GetMessagesPage(ctx, chatID, query)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	err = e.prepareMessages(ctx, query.Viewer, page.Messages)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(page)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// ThreadPage is a page of a thread's replies along with its root.
+type ThreadPage struct {
+	Root *messages.Message `json:"root"`
+	*messages.Page
+}
+
+// GetThread pages the replies of the thread started by the rootId message,
+// with the same parameters as GetMessages.
+func (e *Endpoints) GetThread(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	ctx := context.TODO()
+
+	root, err := e.authorizeMessage(ctx, userIDFromContext(r.Context()), r.URL.Query().Get("rootId"))
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	if root.ThreadRootID != nil {
+		e.handleError(w, fmt.Errorf("%w: not a thread root", errBadRequest))
+		return
+	}
+
+	query, err := e.parsePageQuery(ctx, r, root.ChatID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	page, err := e.MessageDAO.GetThreadPage(ctx, root.ID, query)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	err = e.prepareMessages(ctx, query.Viewer, append([]*messages.Message{root}, page.Messages...))
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	bytes, err := json.Marshal(&ThreadPage{Root: root, Page: page})
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
+
+// SearchMessages runs a text search over the caller's chats. The q
+// parameter is required; chatId, from, after and before (unix nano) and
+// hasAttachment narrow it down. Results come newest first, paged with
+// cursor and limit.
+func (e *Endpoints) SearchMessages(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	ctx := context.TODO()
+
+	query, err := e.parseSearchQuery(ctx, r)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	page, err := e.MessageDAO.Search(ctx, query)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	msgs, err := e.MessageDAO.GetMessagesByChat(ctx, chatID, limit, offset)
+	msgs := make([]*messages.Message, 0, len(page.Results))
+	for _, result := range page.Results {
+		msgs = append(msgs, result.Message)
+	}
+
+	err = e.prepareMessages(ctx, query.Viewer, msgs)
 	if err != nil {
 		e.handleError(w, err)
 		return
 	}
 
-	bytes, err := json.Marshal(msgs)
+	bytes, err := json.Marshal(page)
 	if err != nil {
 		e.handleError(w, err)
 		return
@@ -543,6 +2269,167 @@ func (e *Endpoints) GetMessages(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+func (e *Endpoints) parseSearchQuery(ctx context.Context, r *http.Request) (*messages.SearchQuery, error) {
+	params := r.URL.Query()
+	query := &messages.SearchQuery{
+		Viewer: userIDFromContext(r.Context()),
+		Text:   strings.TrimSpace(params.Get("q")),
+	}
+
+	if query.Text == "" {
+		return nil, fmt.Errorf("%w: q is empty", errBadRequest)
+	}
+
+	if value := params.Get("chatId"); value != "" {
+		chatID, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+
+		_, err = e.authorizeChat(ctx, query.Viewer, chatID)
+		if err != nil {
+			return nil, err
+		}
+		query.ChatIDs = []primitive.ObjectID{chatID}
+	} else {
+		userChats, err := e.ChatDAO.GetChatsByUser(ctx, query.Viewer)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, chat := range userChats {
+			query.ChatIDs = append(query.ChatIDs, chat.ID)
+		}
+	}
+
+	if value := params.Get("from"); value != "" {
+		from, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.From = from
+	}
+
+	if value := params.Get("after"); value != "" {
+		t, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.After = t
+	}
+
+	if value := params.Get("before"); value != "" {
+		t, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.Before = t
+	}
+
+	if value := params.Get("hasAttachment"); value != "" {
+		hasAttachment, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.HasAttachment = hasAttachment
+	}
+
+	if value := params.Get("cursor"); value != "" {
+		c, err := messages.ParseCursor(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.Cursor = c
+	}
+
+	if value := params.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.Limit = n
+	}
+
+	return query, nil
+}
+
+// parsePageQuery reads the pagination parameters of a chat history request:
+// cursor and direction (older or newer, default older), or the before/after
+// shortcuts, and limit. A cursor is either a token from a previous page, a
+// message ID or a unix nano timestamp.
+func (e *Endpoints) parsePageQuery(ctx context.Context, r *http.Request, chatID primitive.ObjectID) (*messages.PageQuery, error) {
+	params := r.URL.Query()
+	query := &messages.PageQuery{
+		Viewer:    userIDFromContext(r.Context()),
+		Direction: messages.Older,
+	}
+
+	cursor := params.Get("cursor")
+	switch direction := messages.Direction(params.Get("direction")); direction {
+	case "":
+	case messages.Older, messages.Newer:
+		query.Direction = direction
+	default:
+		return nil, fmt.Errorf("%w: unknown direction %q", errBadRequest, direction)
+	}
+
+	if before := params.Get("before"); before != "" {
+		cursor = before
+		query.Direction = messages.Older
+	}
+	if after := params.Get("after"); after != "" {
+		cursor = after
+		query.Direction = messages.Newer
+	}
+
+	if cursor != "" {
+		c, err := e.parseCursor(ctx, cursor, chatID)
+		if err != nil {
+			return nil, err
+		}
+		query.Cursor = c
+	}
+
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+		}
+		query.Limit = n
+	}
+
+	return query, nil
+}
+
+func (e *Endpoints) parseCursor(ctx context.Context, value string, chatID primitive.ObjectID) (*messages.Cursor, error) {
+	if msgID, err := primitive.ObjectIDFromHex(value); err == nil {
+		msg, err := e.MessageDAO.GetMessageByID(ctx, msgID)
+		if err == messages.ErrNotFound {
+			return nil, fmt.Errorf("%w: unknown message %s", errBadRequest, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if msg.ChatID != chatID {
+			return nil, errForbidden
+		}
+
+		return messages.CursorOf(msg), nil
+	}
+
+	if t, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return &messages.Cursor{Time: t}, nil
+	}
+
+	c, err := messages.ParseCursor(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errBadRequest, err)
+	}
+
+	return c, nil
+}
+
 type RegisterParams struct {
 	FirstName  string `json:"firstName"`
 	SecondName string `json:"secondName"`
@@ -581,7 +2468,12 @@ func (e *Endpoints) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		FirstName:  params.FirstName,
 		SecondName: params.SecondName,
 		NickName:   params.NickName,
-		Password:   params.Password,
+	}
+
+	err = e.UserDAO.SetPassword(newUser, params.Password)
+	if err != nil {
+		e.handleError(w, err)
+		return
 	}
 
 	err = e.UserDAO.InsertUser(ctx, newUser)
@@ -601,26 +2493,66 @@ func (e *Endpoints) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 
 func (e *Endpoints) handleError(w http.ResponseWriter, err error) {
 	log.Print(err)
-	http.Error(w, err.Error(), 500)
+
+	code := 500
+	switch {
+	case errors.Is(err, errUnauthorized), errors.Is(err, users.ErrInvalidCredentials):
+		code = http.StatusUnauthorized
+	case errors.Is(err, errBadRequest):
+		code = http.StatusBadRequest
+	case errors.Is(err, errForbidden):
+		code = http.StatusForbidden
+	case errors.Is(err, messages.ErrConflict),
+		errors.Is(err, messages.ErrPollClosed),
+		errors.Is(err, chats.ErrAlreadyPinned),
+		errors.Is(err, chats.ErrNotPinned),
+		errors.Is(err, chats.ErrTooManyPins):
+		code = http.StatusConflict
+	case errors.Is(err, errTooManyRequests):
+		code = http.StatusTooManyRequests
+	case errors.Is(err, users.ErrNotFound):
+		code = http.StatusNotFound
+	}
+
+	http.Error(w, err.Error(), code)
 }
 
-func (e *Endpoints) enrichChat(ctx context.Context, chat *chats.Chat) (*chats.Chat, error) {
-	msg, err := e.MessageDAO.GetMessagesByChat(ctx, chat.ID, 1, 0)
+func (e *Endpoints) enrichChat(ctx context.Context, chat *chats.Chat, userID primitive.ObjectID) (*chats.Chat, error) {
+	chat.FillPinnedMessageIDs()
+
+	msg, err := e.MessageDAO.GetLatestMessage(ctx, chat.ID, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(msg) == 0 {
+	if msg == nil {
 		return chat, nil
 	}
 
-	if msg[0].AttachmentLink != nil && msg[0].Text == "" {
+	if msg.Deleted {
+		chat.LastMessage = "deleted message"
+	} else if msg.AttachmentLink != nil && msg.Text == "" {
 		chat.LastMessage = "attachment"
 	} else {
-		chat.LastMessage = msg[0].Text
+		chat.LastMessage = msg.Text
 	}
 
-	chat.LastMessageTime = msg[0].Time
+	chat.LastMessageTime = msg.Time
+
+	marker, err := e.ReceiptDAO.GetMarker(ctx, userID, chat.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var readTime int64
+	if marker != nil {
+		readTime = marker.Time
+	}
+
+	chat.UnreadCount, err = e.MessageDAO.CountUnread(ctx, chat.ID, userID, readTime)
+	if err != nil {
+		return nil, err
+	}
 
 	return chat, nil
 }
@@ -628,6 +2560,17 @@ func (e *Endpoints) enrichChat(ctx context.Context, chat *chats.Chat) (*chats.Ch
 func main() {
 	ctx := context.TODO()
 
+	if path := os.Getenv("AUTH_KEYRING"); path != "" {
+		keyring, err := auth.LoadKeyring(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		auth.SetKeyring(keyring)
+		go keyring.ReloadEvery(time.Minute)
+	} else {
+		log.Print("AUTH_KEYRING is not set, tokens are signed with an ephemeral key")
+	}
+
 	client, err := common.NewClient()
 	if err != nil {
 		log.Fatal(err)
@@ -654,26 +2597,92 @@ func main() {
 		log.Fatal(err)
 	}
 
-	e := NewEndpoints(userDAO, chatDAO, messageDAO, attDAO)
+	sessionDAO, err := sessions.NewDAO(ctx, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	receiptDAO, err := receipts.NewDAO(ctx, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	draftDAO, err := drafts.NewDAO(ctx, client)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var allowedOrigins []string
+	if origins := os.Getenv("WS_ALLOWED_ORIGINS"); origins != "" {
+		allowedOrigins = strings.Split(origins, ",")
+	}
+
+	var backplane hub.Backplane
+	switch os.Getenv("REALTIME_BACKPLANE") {
+	case "", "memory":
+		backplane = hub.NewMemoryBackplane()
+	case "mongo":
+		backplane, err = newMongoBackplane(ctx, client)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown REALTIME_BACKPLANE %q", os.Getenv("REALTIME_BACKPLANE"))
+	}
+
+	eventLog, err := hub.NewEventLog(ctx, client.Database(messages.DBName))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	e := NewEndpoints(userDAO, chatDAO, messageDAO, attDAO, sessionDAO, receiptDAO, draftDAO, allowedOrigins, backplane, eventLog)
+
+	switch os.Getenv("LINK_PREVIEWS") {
+	case "", "off":
+	case "on":
+		e.LinkPreviews = linkpreview.NewHTTPFetcher()
+	default:
+		log.Fatalf("unknown LINK_PREVIEWS %q", os.Getenv("LINK_PREVIEWS"))
+	}
 
 	router := mux.NewRouter()
 	router.Handle("/register/", http.HandlerFunc(e.RegisterHandler)).Methods(http.MethodPost, http.MethodOptions)
-	router.Handle("/getToken/", http.HandlerFunc(e.GetTokenHandler)).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/.well-known/jwks.json", http.HandlerFunc(e.JWKSHandler)).Methods(http.MethodGet)
+	router.Handle("/login", http.HandlerFunc(e.LoginHandler)).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/refreshToken", http.HandlerFunc(e.RefreshTokenHandler)).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/logout", e.Middleware(http.HandlerFunc(e.LogoutHandler))).Methods(http.MethodPost, http.MethodOptions)
 	router.Handle("/users/", e.Middleware(http.HandlerFunc(e.GetUserByIDHandler))).Methods(http.MethodGet, http.MethodOptions)
 	router.Handle("/usersByChat/", e.Middleware(http.HandlerFunc(e.GetUsersByChatHandler))).Methods(http.MethodGet, http.MethodOptions)
 	router.Handle("/me/", e.Middleware(http.HandlerFunc(e.GetMe))).Methods(http.MethodGet, http.MethodOptions)
 	router.Handle("/usersByNickname/", e.Middleware(http.HandlerFunc(e.GetUserByNicknameHandler))).Methods(http.MethodGet, http.MethodOptions)
 	router.Handle("/chats/", e.Middleware(http.HandlerFunc(e.GetChatsByUser))).Methods(http.MethodGet, http.MethodOptions)
 	router.Handle("/messages/", e.Middleware(http.HandlerFunc(e.GetMessages))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/threads/", e.Middleware(http.HandlerFunc(e.GetThread))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/search/", e.Middleware(http.HandlerFunc(e.SearchMessages))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/pinned/", e.Middleware(http.HandlerFunc(e.GetPinned))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/presence/", e.Middleware(http.HandlerFunc(e.GetPresence))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/readMarkers/", e.Middleware(http.HandlerFunc(e.GetReadMarkers))).Methods(http.MethodGet, http.MethodOptions)
+	router.Handle("/drafts/", e.Middleware(http.HandlerFunc(e.GetDrafts))).Methods(http.MethodGet, http.MethodOptions)
 
 	router.Handle("/addChat", e.Middleware(http.HandlerFunc(e.AddChatHandler))).Methods(http.MethodPost, http.MethodOptions)
 	router.Handle("/addMessage", e.Middleware(http.HandlerFunc(e.AddMessageHandler))).Methods(http.MethodPost, http.MethodOptions)
 
+	router.Handle("/editMessage", e.Middleware(http.HandlerFunc(e.EditMessageHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/deleteMessage", e.Middleware(http.HandlerFunc(e.DeleteMessageHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/markRead", e.Middleware(http.HandlerFunc(e.MarkReadHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/saveDraft", e.Middleware(http.HandlerFunc(e.SaveDraftHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/clearDraft", e.Middleware(http.HandlerFunc(e.ClearDraftHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/vote", e.Middleware(http.HandlerFunc(e.VoteHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/closePoll", e.Middleware(http.HandlerFunc(e.ClosePollHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/pinMessage", e.Middleware(http.HandlerFunc(e.PinMessageHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/unpinMessage", e.Middleware(http.HandlerFunc(e.UnpinMessageHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/addReaction", e.Middleware(http.HandlerFunc(e.AddReactionHandler))).Methods(http.MethodPost, http.MethodOptions)
+	router.Handle("/removeReaction", e.Middleware(http.HandlerFunc(e.RemoveReactionHandler))).Methods(http.MethodPost, http.MethodOptions)
+
 	router.Handle("/addAttachment", e.Middleware(http.HandlerFunc(e.UploadAttachmentHandler))).Methods(http.MethodPost, http.MethodOptions)
 	router.Handle("/attachments/", e.Middleware(http.HandlerFunc(e.GetAttachmentHandler))).Methods(http.MethodGet, http.MethodOptions)
 
-	router.Handle("/messageWs/", http.HandlerFunc(e.GetMessageSocketHandler))
-	router.Handle("/chatWs/", http.HandlerFunc(e.GetChatSocketHandler))
+	router.Handle("/ws", http.HandlerFunc(e.SocketHandler))
 
 	http.Handle("/", router)
 
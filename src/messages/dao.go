@@ -2,6 +2,8 @@ package messages
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -13,13 +15,18 @@ import (
 const (
 	DBName = "messenger"
 	CollectionName = "messages"
+	ScheduledCollectionName = "scheduledMessages"
 )
 
+var ErrNotFound = errors.New("message not found")
+var ErrConflict = errors.New("message was changed concurrently")
+var ErrDuplicate = errors.New("message was already sent")
 
 type DAO struct {
 	client *mongo.Client
 	db *mongo.Database
 	collection *mongo.Collection
+	scheduled *mongo.Collection
 }
 
 func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
@@ -27,9 +34,12 @@ func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
 	collection:=db.Collection(CollectionName)
 
 	indexOptions := options.Index().SetUnique(false)
-	indexKeys := bsonx.MDoc{
-		"chatId": bsonx.Int32(1),
-		"time":bsonx.Int32(-1),
+	// Keys have to keep their order, the index backs keyset pagination
+	// by (time, _id) within a chat.
+	indexKeys := bsonx.Doc{
+		{"chatId", bsonx.Int32(1)},
+		{"time", bsonx.Int32(-1)},
+		{"_id", bsonx.Int32(-1)},
 	}
 
 	noteIndexModel := mongo.IndexModel{
@@ -42,33 +52,321 @@ func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
 		return nil, err
 	}
 
+	// Only thread replies have a root, the rest of the collection stays
+	// out of the index.
+	threadIndexModel := mongo.IndexModel{
+		Options: options.Index().SetPartialFilterExpression(bson.D{
+			{"threadRootId", bson.D{{"$exists", true}}},
+		}),
+		Keys: bsonx.Doc{
+			{"threadRootId", bsonx.Int32(1)},
+			{"time", bsonx.Int32(-1)},
+			{"_id", bsonx.Int32(-1)},
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, threadIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without stemming words match whole in every language, which is also
+	// what snippets highlight.
+	textIndexModel := mongo.IndexModel{
+		Options: options.Index().SetDefaultLanguage("none"),
+		Keys: bsonx.Doc{
+			{"text", bsonx.String("text")},
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, textIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
+	clientIDIndexModel := mongo.IndexModel{
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{
+				{"clientMsgId", bson.D{{"$exists", true}}},
+			}),
+		Keys: bsonx.Doc{
+			{"chatId", bsonx.Int32(1)},
+			{"from", bsonx.Int32(1)},
+			{"clientMsgId", bsonx.Int32(1)},
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, clientIDIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
+	expiryIndexModel := mongo.IndexModel{
+		Options: options.Index().SetSparse(true),
+		Keys: bsonx.MDoc{
+			"expiresAt": bsonx.Int32(1),
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, expiryIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
+	pollIndexModel := mongo.IndexModel{
+		Options: options.Index().SetSparse(true),
+		Keys: bsonx.MDoc{
+			"poll.closesAt": bsonx.Int32(1),
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, pollIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
+	scheduled := db.Collection(ScheduledCollectionName)
+	_, err = scheduled.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Options: options.Index().SetUnique(false),
+		Keys: bsonx.MDoc{
+			"sendAt": bsonx.Int32(1),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Retries of a scheduled send are turned away like those of a sent one.
+	_, err = scheduled.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.D{
+				{"message.clientMsgId", bson.D{{"$exists", true}}},
+			}),
+		Keys: bsonx.Doc{
+			{"message.chatId", bsonx.Int32(1)},
+			{"message.from", bsonx.Int32(1)},
+			{"message.clientMsgId", bsonx.Int32(1)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	replyIndexModel := mongo.IndexModel{
+		Options: options.Index().SetSparse(true),
+		Keys: bsonx.MDoc{
+			"replyTo": bsonx.Int32(1),
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, replyIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
+	attachmentIndexModel := mongo.IndexModel{
+		Options: options.Index().SetSparse(true),
+		Keys: bsonx.MDoc{
+			"attachmentLink.attachmentId": bsonx.Int32(1),
+		},
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, attachmentIndexModel)
+	if err != nil {
+		return nil, err
+	}
+
 	return &DAO{
 		client:client,
 		db:db,
 		collection:collection,
+		scheduled: scheduled,
 	}, nil
 }
 
-func (dao *DAO) GetMessagesByChat(ctx context.Context, chatID primitive.ObjectID, limit int, offset int) ([]*Message, error) {
-	filter := bson.D{{"chatId", chatID}}
-	options:=options.Find()
-	options.SetSort(bson.D{{"time", -1}})
-	options.SetLimit(int64(limit))
-	options.SetSkip(int64(offset))
+// GetMessagesPage returns a page of the chat's main timeline, see PageQuery.
+// Thread replies are left out, they are paged with GetThreadPage.
+func (dao *DAO) GetMessagesPage(ctx context.Context, chatID primitive.ObjectID, query *PageQuery) (*Page, error) {
+	filter := bson.D{
+		{"chatId", chatID},
+		{"threadRootId", bson.D{{"$exists", false}}},
+		{"hiddenFor", bson.D{{"$ne", query.Viewer}}},
+	}
+
+	return dao.getPage(ctx, filter, query)
+}
+
+// GetThreadPage returns a page of the replies in the thread started by
+// rootID, see PageQuery.
+func (dao *DAO) GetThreadPage(ctx context.Context, rootID primitive.ObjectID, query *PageQuery) (*Page, error) {
+	filter := bson.D{
+		{"threadRootId", rootID},
+		{"hiddenFor", bson.D{{"$ne", query.Viewer}}},
+	}
+
+	return dao.getPage(ctx, filter, query)
+}
+
+func (dao *DAO) getPage(ctx context.Context, filter bson.D, query *PageQuery) (*Page, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	order := -1
+	if query.Direction == Newer {
+		order = 1
+	}
+
+	if c := query.Cursor; c != nil {
+		op := "$lt"
+		if query.Direction == Newer {
+			op = "$gt"
+		}
+
+		if c.ID.IsZero() {
+			filter = append(filter, bson.E{"time", bson.D{{op, c.Time}}})
+		} else {
+			filter = append(filter, bson.E{"$or", bson.A{
+				bson.D{{"time", bson.D{{op, c.Time}}}},
+				bson.D{{"time", c.Time}, {"_id", bson.D{{op, c.ID}}}},
+			}})
+		}
+	}
+
+	// One extra message tells whether there is more in this direction.
+	opts := options.Find().
+		SetSort(bson.D{{"time", order}, {"_id", order}}).
+		SetLimit(int64(limit + 1))
 
-	cursor, err := dao.collection.Find(context.TODO(), filter)
+	cursor, err := dao.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+
+	hasMore := len(msgs) > limit
+	if hasMore {
+		msgs = msgs[:limit]
+	}
+
+	if query.Direction == Newer {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+
+	page := &Page{Messages: msgs}
+	if page.Messages == nil {
+		page.Messages = []*Message{}
+	}
+
+	if len(msgs) == 0 {
+		if query.Cursor != nil {
+			page.PrevCursor = query.Cursor.String()
+		}
+		return page, nil
+	}
+
+	// Paging forward from a cursor, the history behind it is still there
+	// to go back to.
+	olderExist := hasMore
+	if query.Direction == Newer {
+		olderExist = query.Cursor != nil
+	}
+
+	if olderExist {
+		page.NextCursor = CursorOf(msgs[len(msgs)-1]).String()
+	}
+	page.PrevCursor = CursorOf(msgs[0]).String()
+
+	return page, nil
+}
+
+// GetLatestMessage returns the newest message of the chat visible to viewer
+// or nil if there is none.
+func (dao *DAO) GetLatestMessage(ctx context.Context, chatID, viewer primitive.ObjectID) (*Message, error) {
+	page, err := dao.GetMessagesPage(ctx, chatID, &PageQuery{Viewer: viewer, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.Messages) == 0 {
+		return nil, nil
+	}
+
+	return page.Messages[0], nil
+}
+
+// CountUnread counts the messages of the chat's main timeline that others
+// sent after afterTime and viewer can still see.
+func (dao *DAO) CountUnread(ctx context.Context, chatID, viewer primitive.ObjectID, afterTime int64) (int64, error) {
+	filter := bson.D{
+		{"chatId", chatID},
+		{"time", bson.D{{"$gt", afterTime}}},
+		{"from", bson.D{{"$ne", viewer}}},
+		{"threadRootId", bson.D{{"$exists", false}}},
+		{"deleted", bson.D{{"$ne", true}}},
+		{"hiddenFor", bson.D{{"$ne", viewer}}},
+	}
+
+	return dao.collection.CountDocuments(ctx, filter)
+}
+
+func (dao *DAO) GetMessageByID(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	filter := bson.D{{"_id", id}}
+
+	var msg *Message
+	err := dao.collection.FindOne(ctx, filter).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (dao *DAO) GetMessagesByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*Message, error) {
+	filter := bson.D{{"_id", bson.D{{"$in", ids}}}}
+
+	cursor, err := dao.collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
 
 	var result []*Message
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
 
-	for cursor.Next(ctx) {
-		var message *Message
-		if err:=cursor.Decode(&message); err!=nil {
-			return nil, err
+// GetChatIDsByAttachment returns the chats where the attachment was sent.
+func (dao *DAO) GetChatIDsByAttachment(ctx context.Context, attachmentID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	filter := bson.D{{"attachmentLink.attachmentId", attachmentID}}
+
+	values, err := dao.collection.Distinct(ctx, "chatId", filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []primitive.ObjectID
+	for _, value := range values {
+		if chatID, ok := value.(primitive.ObjectID); ok {
+			result = append(result, chatID)
 		}
-		result = append(result, message)
 	}
 
 	return result, nil
@@ -76,12 +374,480 @@ func (dao *DAO) GetMessagesByChat(ctx context.Context, chatID primitive.ObjectID
 
 func (dao *DAO) AddMessage(ctx context.Context, msg *Message) error {
 	if _, err:= dao.collection.InsertOne(ctx, msg); err!=nil {
+		if isDuplicateKey(err) {
+			return ErrDuplicate
+		}
 		return err
 	}
 
 	return nil
 }
 
+// GetMessageByClientID returns the message the sender sent, or scheduled,
+// to the chat with the given client message ID.
+func (dao *DAO) GetMessageByClientID(ctx context.Context, chatID, from primitive.ObjectID, clientMsgID string) (*Message, error) {
+	filter := bson.D{
+		{"chatId", chatID},
+		{"from", from},
+		{"clientMsgId", clientMsgID},
+	}
+
+	var msg *Message
+	err := dao.collection.FindOne(ctx, filter).Decode(&msg)
+	if err == nil {
+		return msg, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	// Looked up after the sent ones: a scheduled message is sent before it
+	// is removed from the schedule.
+	filter = bson.D{
+		{"message.chatId", chatID},
+		{"message.from", from},
+		{"message.clientMsgId", clientMsgID},
+	}
+
+	var scheduled *ScheduledMessage
+	err = dao.scheduled.FindOne(ctx, filter).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scheduled.Message, nil
+}
+
+func isDuplicateKey(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == 11000 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddThreadReply counts a reply sent at replyTime in the thread started by
+// rootID and returns the updated root.
+func (dao *DAO) AddThreadReply(ctx context.Context, rootID primitive.ObjectID, replyTime int64) (*Message, error) {
+	filter := bson.D{{"_id", rootID}}
+	update := bson.D{
+		{"$inc", bson.D{{"threadReplyCount", 1}}},
+		{"$max", bson.D{{"threadLastReplyAt", replyTime}}},
+	}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// RemoveThreadReply uncounts a deleted reply in the thread started by
+// rootID and returns the updated root.
+func (dao *DAO) RemoveThreadReply(ctx context.Context, rootID primitive.ObjectID) (*Message, error) {
+	filter := bson.D{
+		{"_id", rootID},
+		{"threadReplyCount", bson.D{{"$gt", 0}}},
+	}
+	update := bson.D{{"$inc", bson.D{{"threadReplyCount", -1}}}}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// AddReaction records that userID reacted to the message with emoji, see
+// ValidateEmoji. Reacting twice with the same emoji has no effect.
+func (dao *DAO) AddReaction(ctx context.Context, id primitive.ObjectID, emoji string, userID primitive.ObjectID) (*Message, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deleted", bson.D{{"$ne", true}}},
+	}
+	update := bson.D{{"$addToSet", bson.D{{"reactions." + emoji, userID}}}}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// RemoveReaction takes back the reaction of userID with emoji.
+func (dao *DAO) RemoveReaction(ctx context.Context, id primitive.ObjectID, emoji string, userID primitive.ObjectID) (*Message, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deleted", bson.D{{"$ne", true}}},
+	}
+	update := bson.D{{"$pull", bson.D{{"reactions." + emoji, userID}}}}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// SetDeliveryState moves the delivery of the message to userID forward to
+// state. It fails with ErrConflict if the delivery is already there or the
+// user is not a recipient.
+func (dao *DAO) SetDeliveryState(ctx context.Context, id, userID primitive.ObjectID, state string) (*Message, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deliveries", bson.D{{"$elemMatch", bson.D{
+			{"userId", userID},
+			{"state", bson.D{{"$in", statesBefore(state)}}},
+		}}}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"deliveries.$.state", state},
+		{"deliveries.$.time", time.Now().UnixNano()},
+	}}}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// MarkReadUpTo marks up to limit messages of the chat's main timeline sent
+// up to upTo as read by userID, oldest first, and returns the senders whose
+// messages changed. Messages left over are marked by a later call.
+func (dao *DAO) MarkReadUpTo(ctx context.Context, chatID, userID primitive.ObjectID, upTo int64, limit int) ([]primitive.ObjectID, error) {
+	unread := bson.D{{"$elemMatch", bson.D{
+		{"userId", userID},
+		{"state", bson.D{{"$ne", StatusRead}}},
+	}}}
+	filter := bson.D{
+		{"chatId", chatID},
+		{"time", bson.D{{"$lte", upTo}}},
+		{"threadRootId", bson.D{{"$exists", false}}},
+		{"deliveries", unread},
+	}
+	opts := options.Find().
+		SetProjection(bson.D{{"_id", 1}, {"from", 1}}).
+		SetSort(bson.D{{"time", 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := dao.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*Message
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(found))
+	seen := make(map[primitive.ObjectID]bool)
+	var senders []primitive.ObjectID
+	for _, msg := range found {
+		ids = append(ids, msg.ID)
+		if !seen[msg.From] {
+			seen[msg.From] = true
+			senders = append(senders, msg.From)
+		}
+	}
+
+	update := bson.D{{"$set", bson.D{
+		{"deliveries.$[d].state", StatusRead},
+		{"deliveries.$[d].time", time.Now().UnixNano()},
+	}}}
+	updateOpts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{bson.D{
+			{"d.userId", userID},
+			{"d.state", bson.D{{"$ne", StatusRead}}},
+		}},
+	})
+
+	_, err = dao.collection.UpdateMany(ctx, bson.D{{"_id", bson.D{{"$in", ids}}}}, update, updateOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	return senders, nil
+}
+
+// EditMessage replaces the text of the message and its entities and keeps
+// the previous text in its revisions. The link preview is dropped, it may
+// not match the new text. It fails with ErrConflict if the message changed
+// since msg was read.
+func (dao *DAO) EditMessage(ctx context.Context, msg *Message, text string, entities []*Entity) (*Message, error) {
+	previousTime := msg.Time
+	if msg.EditedAt != 0 {
+		previousTime = msg.EditedAt
+	}
+
+	filter := bson.D{
+		{"_id", msg.ID},
+		{"text", msg.Text},
+		{"deleted", bson.D{{"$ne", true}}},
+	}
+	update := bson.D{
+		{"$set", bson.D{
+			{"text", text},
+			{"entities", entities},
+			{"editedAt", time.Now().UnixNano()},
+		}},
+		{"$unset", bson.D{
+			{"linkPreview", ""},
+		}},
+		{"$push", bson.D{
+			{"revisions", &Revision{Text: msg.Text, Time: previousTime}},
+		}},
+	}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// Vote replaces the vote of userID in the poll of the message, no choices
+// retract it. It fails with ErrPollClosed once the poll is closed.
+func (dao *DAO) Vote(ctx context.Context, id, userID primitive.ObjectID, choices []int) (*Message, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deleted", bson.D{{"$ne", true}}},
+		{"poll", bson.D{{"$exists", true}}},
+		{"poll.closed", bson.D{{"$ne", true}}},
+		{"$or", bson.A{
+			bson.D{{"poll.closesAt", bson.D{{"$exists", false}}}},
+			bson.D{{"poll.closesAt", bson.D{{"$gt", time.Now().UnixNano()}}}},
+		}},
+	}
+
+	key := "poll.votes." + userID.Hex()
+	update := bson.D{{"$set", bson.D{{key, choices}}}}
+	if len(choices) == 0 {
+		update = bson.D{{"$unset", bson.D{{key, ""}}}}
+	}
+
+	msg, err := dao.findOneAndUpdate(ctx, filter, update)
+	if err == ErrConflict {
+		return nil, ErrPollClosed
+	}
+
+	return msg, err
+}
+
+// ClosePoll closes the poll of the message, freezing its votes. It fails
+// with ErrPollClosed if it is already closed.
+func (dao *DAO) ClosePoll(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"poll", bson.D{{"$exists", true}}},
+		{"poll.closed", bson.D{{"$ne", true}}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"poll.closed", true},
+		{"poll.closedAt", time.Now().UnixNano()},
+	}}}
+
+	msg, err := dao.findOneAndUpdate(ctx, filter, update)
+	if err == ErrConflict {
+		return nil, ErrPollClosed
+	}
+
+	return msg, err
+}
+
+// GetDuePolls returns up to limit open polls whose close time has passed.
+func (dao *DAO) GetDuePolls(ctx context.Context, now int64, limit int) ([]*Message, error) {
+	filter := bson.D{
+		{"poll.closesAt", bson.D{{"$lte", now}}},
+		{"poll.closed", bson.D{{"$ne", true}}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"poll.closesAt", 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := dao.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Message
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SetLinkPreview stores the preview of the message's first link. It fails
+// with ErrConflict if link is no longer the first one, e.g. because the
+// message was edited while the preview was fetched.
+func (dao *DAO) SetLinkPreview(ctx context.Context, id primitive.ObjectID, link string, preview *LinkPreview) (*Message, error) {
+	urls := bson.D{{"$filter", bson.D{
+		{"input", "$entities"},
+		{"as", "e"},
+		{"cond", bson.D{{"$eq", bson.A{"$$e.type", EntityURL}}}},
+	}}}
+	firstURL := bson.D{{"$let", bson.D{
+		{"vars", bson.D{{"first", bson.D{{"$arrayElemAt", bson.A{urls, 0}}}}}},
+		{"in", "$$first.url"},
+	}}}
+
+	filter := bson.D{
+		{"_id", id},
+		{"deleted", bson.D{{"$ne", true}}},
+		{"$expr", bson.D{{"$eq", bson.A{firstURL, link}}}},
+	}
+	update := bson.D{{"$set", bson.D{{"linkPreview", preview}}}}
+
+	return dao.findOneAndUpdate(ctx, filter, update)
+}
+
+// DeleteMessage turns the message into a tombstone for everyone, dropping
+// its content and revisions along with the quotes of it in replies. It
+// fails with ErrConflict if the message is already deleted, so that only
+// one caller cleans up after it.
+func (dao *DAO) DeleteMessage(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	filter := bson.D{
+		{"_id", id},
+		{"deleted", bson.D{{"$ne", true}}},
+	}
+
+	msg, err := dao.findOneAndUpdate(ctx, filter, tombstoneUpdate())
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, dao.dropQuotes(ctx, id)
+}
+
+// ExpireMessage deletes a self-destructing message like DeleteMessage.
+func (dao *DAO) ExpireMessage(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	return dao.DeleteMessage(ctx, id)
+}
+
+// dropQuotes removes the quotes of a deleted message from the replies to
+// it, which would otherwise keep part of its text.
+func (dao *DAO) dropQuotes(ctx context.Context, id primitive.ObjectID) error {
+	filter := bson.D{
+		{"replyTo", id},
+		{"quote", bson.D{{"$exists", true}}},
+	}
+	update := bson.D{{"$unset", bson.D{{"quote", ""}}}}
+
+	_, err := dao.collection.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// GetExpiredMessages returns up to limit messages that expired by now and
+// are not deleted yet.
+func (dao *DAO) GetExpiredMessages(ctx context.Context, now int64, limit int) ([]*Message, error) {
+	filter := bson.D{
+		{"expiresAt", bson.D{{"$lte", now}}},
+		{"deleted", bson.D{{"$ne", true}}},
+	}
+	opts := options.Find().
+		SetSort(bson.D{{"expiresAt", 1}}).
+		SetLimit(int64(limit))
+
+	cursor, err := dao.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*Message
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ScheduleMessage stores msg to be sent at sendAt. It fails with
+// ErrDuplicate if the sender already scheduled a message with its client
+// message ID.
+func (dao *DAO) ScheduleMessage(ctx context.Context, msg *Message, sendAt int64) (*ScheduledMessage, error) {
+	scheduled := &ScheduledMessage{
+		ID: msg.ID,
+		Message: msg,
+		SendAt: sendAt,
+	}
+
+	if _, err := dao.scheduled.InsertOne(ctx, scheduled); err != nil {
+		if isDuplicateKey(err) {
+			return nil, ErrDuplicate
+		}
+		return nil, err
+	}
+
+	return scheduled, nil
+}
+
+// ClaimScheduledMessage returns a message due by now that no other instance
+// is sending, and claims it for claimFor. It returns nil when there is none.
+// A claim that is not completed with RemoveScheduledMessage runs out, so
+// messages of a crashed instance are sent by another one.
+func (dao *DAO) ClaimScheduledMessage(ctx context.Context, now int64, claimFor time.Duration) (*ScheduledMessage, error) {
+	filter := bson.D{
+		{"sendAt", bson.D{{"$lte", now}}},
+		{"claimedUntil", bson.D{{"$lt", now}}},
+	}
+	update := bson.D{{"$set", bson.D{{"claimedUntil", now + claimFor.Nanoseconds()}}}}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{"sendAt", 1}}).
+		SetReturnDocument(options.After)
+
+	var scheduled *ScheduledMessage
+	err := dao.scheduled.FindOneAndUpdate(ctx, filter, update, opts).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return scheduled, nil
+}
+
+func (dao *DAO) RemoveScheduledMessage(ctx context.Context, id primitive.ObjectID) error {
+	_, err := dao.scheduled.DeleteOne(ctx, bson.D{{"_id", id}})
+	return err
+}
+
+func tombstoneUpdate() bson.D {
+	return bson.D{
+		{"$set", bson.D{
+			{"text", ""},
+			{"deleted", true},
+			{"deletedAt", time.Now().UnixNano()},
+		}},
+		{"$unset", bson.D{
+			{"attachmentLink", ""},
+			{"revisions", ""},
+			{"reactions", ""},
+			{"entities", ""},
+			{"linkPreview", ""},
+			{"poll", ""},
+		}},
+	}
+}
+
+// HideMessage deletes the message for userID only.
+func (dao *DAO) HideMessage(ctx context.Context, id, userID primitive.ObjectID) error {
+	filter := bson.D{{"_id", id}}
+	update := bson.D{{"$addToSet", bson.D{{"hiddenFor", userID}}}}
+
+	_, err := dao.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// findOneAndUpdate applies update and returns the updated message, or
+// ErrConflict if filter did not match.
+func (dao *DAO) findOneAndUpdate(ctx context.Context, filter, update interface{}) (*Message, error) {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var msg *Message
+	err := dao.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&msg)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrConflict
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
 func (dao *DAO) Drop(ctx context.Context) error{
 	return dao.collection.Drop(ctx)
 }
\ No newline at end of file
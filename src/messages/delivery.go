@@ -0,0 +1,83 @@
+package messages
+
+import (
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Delivery states of a message for one recipient. They only move forward.
+const (
+	StatusSent      = "sent"
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+var ErrInvalidStatus = errors.New("invalid delivery status")
+
+// Delivery is the state of a message for one recipient and when it was
+// reached.
+type Delivery struct {
+	UserID primitive.ObjectID `bson:"userId" json:"userId"`
+	State  string             `bson:"state" json:"state"`
+	Time   int64              `bson:"time" json:"time"`
+}
+
+func statusRank(state string) int {
+	switch state {
+	case StatusSent:
+		return 1
+	case StatusDelivered:
+		return 2
+	case StatusRead:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// ValidateAckStatus checks a state a recipient may report.
+func ValidateAckStatus(state string) error {
+	if state != StatusDelivered && state != StatusRead {
+		return ErrInvalidStatus
+	}
+
+	return nil
+}
+
+// statesBefore lists the states a delivery can move from to reach state.
+func statesBefore(state string) []string {
+	var result []string
+	for _, s := range []string{StatusSent, StatusDelivered} {
+		if statusRank(s) < statusRank(state) {
+			result = append(result, s)
+		}
+	}
+
+	return result
+}
+
+// AggregateStatus sets Status to the state every recipient has reached:
+// read once all of them read the message, delivered once it reached all of
+// their devices, sent otherwise.
+func (m *Message) AggregateStatus() {
+	m.Status = ""
+
+	for _, d := range m.Deliveries {
+		if m.Status == "" || statusRank(d.State) < statusRank(m.Status) {
+			m.Status = d.State
+		}
+	}
+}
+
+// DeliveryFor returns the delivery state of the message for userID or nil
+// if they are not a recipient.
+func (m *Message) DeliveryFor(userID primitive.ObjectID) *Delivery {
+	for _, d := range m.Deliveries {
+		if d.UserID == userID {
+			return d
+		}
+	}
+
+	return nil
+}
@@ -17,5 +17,134 @@ type Message struct {
 	ChatID primitive.ObjectID `bson:"chatId" json:"chatId"`
 	Text string `bson:"text" json:"text"`
 	Time int64 `bson:"time" json:"time"`
+	// ClientMsgID is chosen by the sender's client to make retries of the
+	// same message idempotent.
+	ClientMsgID string `bson:"clientMsgId,omitempty" json:"clientMsgId,omitempty"`
+	// ScheduledAt is when a scheduled message was scheduled, it is sent at
+	// Time.
+	ScheduledAt int64 `bson:"scheduledAt,omitempty" json:"scheduledAt,omitempty"`
+	// Self-destructing messages are deleted for everyone ExpiresAfter
+	// seconds after they were sent, at ExpiresAt.
+	ExpiresAfter int64 `bson:"expiresAfter,omitempty" json:"expiresAfter,omitempty"`
+	ExpiresAt int64 `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
 	AttachmentLink *AttachmentLink `bson:"attachmentLink,omitempty" json:"attachmentLink,omitempty"`
+	// Entities mark formatting, mentions, links and hashtags in Text, see
+	// ParseText.
+	Entities []*Entity `bson:"entities,omitempty" json:"entities,omitempty"`
+	LinkPreview *LinkPreview `bson:"linkPreview,omitempty" json:"linkPreview,omitempty"`
+	Poll *Poll `bson:"poll,omitempty" json:"poll,omitempty"`
+
+	// ReplyTo is a message of the same chat this one answers, optionally
+	// quoting a part of it.
+	ReplyTo *primitive.ObjectID `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+	Quote *Quote `bson:"quote,omitempty" json:"quote,omitempty"`
+	ReplyPreview *Preview `bson:"-" json:"replyPreview,omitempty"`
+	ForwardedFrom *ForwardInfo `bson:"forwardedFrom,omitempty" json:"forwardedFrom,omitempty"`
+
+	// ThreadRootID is set on replies in a thread, they are not part of the
+	// chat's main timeline. The root keeps count of its replies.
+	ThreadRootID *primitive.ObjectID `bson:"threadRootId,omitempty" json:"threadRootId,omitempty"`
+	ThreadReplyCount int `bson:"threadReplyCount,omitempty" json:"threadReplyCount,omitempty"`
+	ThreadLastReplyAt int64 `bson:"threadLastReplyAt,omitempty" json:"threadLastReplyAt,omitempty"`
+
+	// Reactions maps an emoji to the users who reacted with it. Clients get
+	// ReactionCounts instead.
+	Reactions map[string][]primitive.ObjectID `bson:"reactions,omitempty" json:"-"`
+	ReactionCounts []*ReactionCount `bson:"-" json:"reactions,omitempty"`
+
+	// Deliveries holds the state of the message for every recipient, Status
+	// sums them up for clients.
+	Deliveries []*Delivery `bson:"deliveries,omitempty" json:"-"`
+	Status string `bson:"-" json:"status,omitempty"`
+
+	EditedAt int64 `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+	Revisions []*Revision `bson:"revisions,omitempty" json:"revisions,omitempty"`
+	// Deleted messages are kept as tombstones without content so that
+	// clients can show where they were.
+	Deleted bool `bson:"deleted,omitempty" json:"deleted,omitempty"`
+	DeletedAt int64 `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	// HiddenFor lists users who deleted the message for themselves only.
+	HiddenFor []primitive.ObjectID `bson:"hiddenFor,omitempty" json:"-"`
+}
+
+// LinkPreview describes the first link of a message.
+type LinkPreview struct {
+	URL string `bson:"url" json:"url"`
+	Title string `bson:"title,omitempty" json:"title,omitempty"`
+	Description string `bson:"description,omitempty" json:"description,omitempty"`
+	Image string `bson:"image,omitempty" json:"image,omitempty"`
+}
+
+// ScheduledMessage waits in its own collection until SendAt, when it is
+// inserted into the chat. ClaimedUntil keeps other instances from sending
+// it at the same time.
+type ScheduledMessage struct {
+	ID primitive.ObjectID `bson:"_id" json:"id"`
+	Message *Message `bson:"message" json:"message"`
+	SendAt int64 `bson:"sendAt" json:"sendAt"`
+	ClaimedUntil int64 `bson:"claimedUntil" json:"-"`
+}
+
+// Quote is the part of the replied message the reply refers to. Offset and
+// Length are in runes of the replied message's text.
+type Quote struct {
+	Text string `bson:"text" json:"text"`
+	Offset int `bson:"offset" json:"offset"`
+	Length int `bson:"length" json:"length"`
+}
+
+// ForwardInfo points to the original of a forwarded message. Forwarding a
+// forwarded message keeps pointing to the original.
+type ForwardInfo struct {
+	From primitive.ObjectID `bson:"from" json:"from"`
+	ChatID primitive.ObjectID `bson:"chatId" json:"chatId"`
+	MessageID primitive.ObjectID `bson:"messageId" json:"messageId"`
+	Time int64 `bson:"time" json:"time"`
+}
+
+const previewLength = 100
+
+// Preview is a compact form of a message embedded into messages that refer
+// to it.
+type Preview struct {
+	ID primitive.ObjectID `json:"id"`
+	From primitive.ObjectID `json:"from"`
+	Text string `json:"text,omitempty"`
+	HasAttachment bool `json:"hasAttachment,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func NewPreview(msg *Message) *Preview {
+	preview := &Preview{
+		ID: msg.ID,
+		From: msg.From,
+		HasAttachment: msg.AttachmentLink != nil,
+		Deleted: msg.Deleted,
+	}
+
+	text := []rune(msg.Text)
+	if len(text) > previewLength {
+		preview.Text = string(text[:previewLength]) + "…"
+	} else {
+		preview.Text = msg.Text
+	}
+
+	return preview
+}
+
+// Revision is a previous version of an edited message. Time is when that
+// version was written.
+type Revision struct {
+	Text string `bson:"text" json:"text"`
+	Time int64 `bson:"time" json:"time"`
+}
+
+func (m *Message) IsHiddenFor(userID primitive.ObjectID) bool {
+	for _, id := range m.HiddenFor {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
 }
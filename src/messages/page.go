@@ -0,0 +1,89 @@
+package messages
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 100
+)
+
+type Direction string
+
+const (
+	// Older pages go back in history from the cursor.
+	Older Direction = "older"
+	// Newer pages go forward from the cursor towards the latest message.
+	Newer Direction = "newer"
+)
+
+var ErrMalformedCursor = errors.New("malformed cursor")
+
+// Cursor is a position in a chat's history. Messages are ordered by time and
+// then by ID, so the pair identifies a position even if several messages
+// share a timestamp. A cursor with a zero ID is a plain timestamp.
+type Cursor struct {
+	Time int64
+	ID   primitive.ObjectID
+}
+
+func CursorOf(msg *Message) *Cursor {
+	return &Cursor{Time: msg.Time, ID: msg.ID}
+}
+
+// String encodes the cursor into the opaque token returned to clients.
+func (c *Cursor) String() string {
+	raw := fmt.Sprintf("%d:%s", c.Time, c.ID.Hex())
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseCursor decodes a token produced by Cursor.String.
+func ParseCursor(token string) (*Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrMalformedCursor
+	}
+
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 2 {
+		return nil, ErrMalformedCursor
+	}
+
+	t, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, ErrMalformedCursor
+	}
+
+	id, err := primitive.ObjectIDFromHex(parts[1])
+	if err != nil {
+		return nil, ErrMalformedCursor
+	}
+
+	return &Cursor{Time: t, ID: id}, nil
+}
+
+// PageQuery selects up to Limit messages of a chat on the Direction side of
+// Cursor. A nil Cursor starts from the latest message. Messages Viewer
+// deleted for themselves are left out.
+type PageQuery struct {
+	Viewer    primitive.ObjectID
+	Cursor    *Cursor
+	Direction Direction
+	Limit     int
+}
+
+// Page is a slice of a chat's history, newest message first. NextCursor
+// continues towards older messages and is empty once the beginning of the
+// chat is reached. PrevCursor continues towards newer messages.
+type Page struct {
+	Messages   []*Message `json:"messages"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+	PrevCursor string     `json:"prevCursor,omitempty"`
+}
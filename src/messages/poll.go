@@ -0,0 +1,108 @@
+package messages
+
+import (
+	"errors"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	MaxPollOptions       = 10
+	MaxPollQuestionRunes = 300
+	MaxPollOptionRunes   = 100
+)
+
+var ErrPollClosed = errors.New("poll is closed")
+
+// Poll is attached to a message, whose text is the question. Votes maps the
+// hex ID of every voter to the indexes of the options they chose. Once the
+// poll is closed its votes no longer change, so the results are final.
+type Poll struct {
+	Question       string           `bson:"question" json:"question"`
+	Options        []*PollOption    `bson:"options" json:"options"`
+	MultipleChoice bool             `bson:"multipleChoice" json:"multipleChoice"`
+	Anonymous      bool             `bson:"anonymous" json:"anonymous"`
+	ClosesAt       int64            `bson:"closesAt,omitempty" json:"closesAt,omitempty"`
+	Closed         bool             `bson:"closed,omitempty" json:"closed"`
+	ClosedAt       int64            `bson:"closedAt,omitempty" json:"closedAt,omitempty"`
+	Votes          map[string][]int `bson:"votes,omitempty" json:"-"`
+
+	// Filled in by Tally.
+	TotalVoters int   `bson:"-" json:"totalVoters"`
+	MyChoices   []int `bson:"-" json:"myChoices,omitempty"`
+}
+
+// PollOption is a possible answer. Count and Voters are filled in by Tally,
+// Voters only for public polls.
+type PollOption struct {
+	Text   string               `bson:"text" json:"text"`
+	Count  int                  `bson:"-" json:"count"`
+	Voters []primitive.ObjectID `bson:"-" json:"voters,omitempty"`
+}
+
+// IsOpen tells whether votes are still accepted at now.
+func (p *Poll) IsOpen(now int64) bool {
+	return !p.Closed && (p.ClosesAt == 0 || now < p.ClosesAt)
+}
+
+// ValidateChoices checks a vote. No choice at all retracts the vote.
+func (p *Poll) ValidateChoices(choices []int) error {
+	if len(choices) > 1 && !p.MultipleChoice {
+		return errors.New("poll allows a single choice")
+	}
+
+	seen := make(map[int]bool)
+	for _, i := range choices {
+		if i < 0 || i >= len(p.Options) {
+			return errors.New("unknown poll option")
+		}
+		if seen[i] {
+			return errors.New("duplicate poll option")
+		}
+		seen[i] = true
+	}
+
+	return nil
+}
+
+// Tally counts the votes per option as seen by viewer. A zero viewer gets
+// no MyChoices.
+func (p *Poll) Tally(viewer primitive.ObjectID) {
+	for _, option := range p.Options {
+		option.Count = 0
+		option.Voters = nil
+	}
+	p.TotalVoters = len(p.Votes)
+	p.MyChoices = nil
+
+	voters := make([]string, 0, len(p.Votes))
+	for voter := range p.Votes {
+		voters = append(voters, voter)
+	}
+	// Keep voter lists stable between requests.
+	sort.Strings(voters)
+
+	for _, voter := range voters {
+		userID, err := primitive.ObjectIDFromHex(voter)
+		if err != nil {
+			continue
+		}
+
+		for _, i := range p.Votes[voter] {
+			if i < 0 || i >= len(p.Options) {
+				continue
+			}
+
+			option := p.Options[i]
+			option.Count++
+			if !p.Anonymous {
+				option.Voters = append(option.Voters, userID)
+			}
+		}
+	}
+
+	if !viewer.IsZero() {
+		p.MyChoices = p.Votes[viewer.Hex()]
+	}
+}
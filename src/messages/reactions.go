@@ -0,0 +1,84 @@
+package messages
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MaxEmojiLength is enough for the longest ZWJ sequences.
+const MaxEmojiLength = 32
+
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+// ReactionCount aggregates the users who reacted with Emoji. Me tells
+// whether the viewer is one of them.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me,omitempty"`
+}
+
+// ValidateEmoji checks that emoji can be used as a reaction. Emojis are
+// stored as document keys, so dots and leading dollars are rejected along
+// with plain text.
+func ValidateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > MaxEmojiLength || !utf8.ValidString(emoji) {
+		return ErrInvalidEmoji
+	}
+
+	if strings.ContainsAny(emoji, ".$") {
+		return ErrInvalidEmoji
+	}
+
+	// Keycaps start with an ASCII digit, but every emoji has some
+	// non-ASCII part.
+	ascii := true
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsLetter(r) {
+			return ErrInvalidEmoji
+		}
+		if r >= utf8.RuneSelf {
+			ascii = false
+		}
+	}
+
+	if ascii {
+		return ErrInvalidEmoji
+	}
+
+	return nil
+}
+
+// CountReactions sets ReactionCounts as seen by viewer, the most used
+// reactions first.
+func (m *Message) CountReactions(viewer primitive.ObjectID) {
+	m.ReactionCounts = nil
+
+	for emoji, users := range m.Reactions {
+		if len(users) == 0 {
+			continue
+		}
+
+		count := &ReactionCount{Emoji: emoji, Count: len(users)}
+		for _, id := range users {
+			if id == viewer {
+				count.Me = true
+				break
+			}
+		}
+		m.ReactionCounts = append(m.ReactionCounts, count)
+	}
+
+	sort.Slice(m.ReactionCounts, func(i, j int) bool {
+		a, b := m.ReactionCounts[i], m.ReactionCounts[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Emoji < b.Emoji
+	})
+}
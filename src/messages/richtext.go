@@ -0,0 +1,243 @@
+package messages
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Entity types. Bold, italic and code come from markup that is removed from
+// the text, the others are recognized in the text as is.
+const (
+	EntityBold    = "bold"
+	EntityItalic  = "italic"
+	EntityCode    = "code"
+	EntityMention = "mention"
+	EntityURL     = "url"
+	EntityHashtag = "hashtag"
+)
+
+// Entity marks a span of a message's text, in runes. Mentions carry the
+// mentioned user, URLs their address.
+type Entity struct {
+	Type   string              `bson:"type" json:"type"`
+	Offset int                 `bson:"offset" json:"offset"`
+	Length int                 `bson:"length" json:"length"`
+	UserID *primitive.ObjectID `bson:"userId,omitempty" json:"userId,omitempty"`
+	URL    string              `bson:"url,omitempty" json:"url,omitempty"`
+
+	// Nickname of a mention, until it is resolved to UserID.
+	Nickname string `bson:"-" json:"-"`
+}
+
+var markers = map[rune]string{
+	'*': EntityBold,
+	'_': EntityItalic,
+	'`': EntityCode,
+}
+
+// ParseText strips the *bold*, _italic_ and `code` markup from raw and
+// returns the plain text with its entities, ordered by offset. Mentions are
+// left unresolved, see Entity.Nickname.
+func ParseText(raw string) (string, []*Entity) {
+	text, entities := parseMarkup([]rune(raw), 0)
+
+	var code []*Entity
+	for _, e := range entities {
+		if e.Type == EntityCode {
+			code = append(code, e)
+		}
+	}
+
+	for _, e := range findInlineEntities(text) {
+		if !overlapsAny(e, code) {
+			entities = append(entities, e)
+		}
+	}
+
+	sortEntities(entities)
+
+	return string(text), entities
+}
+
+// parseMarkup removes markup from runes. base is the offset of runes in the
+// final text.
+func parseMarkup(runes []rune, base int) ([]rune, []*Entity) {
+	var out []rune
+	var entities []*Entity
+
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		entityType, ok := markers[r]
+		if !ok || !opensAt(runes, i) {
+			out = append(out, r)
+			continue
+		}
+
+		end := closingMarker(runes, i)
+		if end < 0 {
+			out = append(out, r)
+			continue
+		}
+
+		inner := runes[i+1 : end]
+		offset := base + len(out)
+		if entityType == EntityCode {
+			out = append(out, inner...)
+		} else {
+			text, nested := parseMarkup(inner, offset)
+			out = append(out, text...)
+			entities = append(entities, nested...)
+			inner = text
+		}
+
+		entities = append(entities, &Entity{
+			Type:   entityType,
+			Offset: offset,
+			Length: len(inner),
+		})
+		i = end
+	}
+
+	return out, entities
+}
+
+// opensAt tells whether the marker at i can open a span: it starts a word
+// and is followed by something other than a space.
+func opensAt(runes []rune, i int) bool {
+	if i > 0 && isWordRune(runes[i-1]) {
+		return false
+	}
+
+	return i+1 < len(runes) && !unicode.IsSpace(runes[i+1])
+}
+
+// closingMarker finds the marker closing the one at i on the same line, or
+// returns -1.
+func closingMarker(runes []rune, i int) int {
+	marker := runes[i]
+	for j := i + 2; j < len(runes); j++ {
+		if runes[j] == '\n' {
+			return -1
+		}
+		if runes[j] != marker || unicode.IsSpace(runes[j-1]) {
+			continue
+		}
+		if j+1 < len(runes) && isWordRune(runes[j+1]) {
+			continue
+		}
+
+		return j
+	}
+
+	return -1
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// findInlineEntities finds mentions, URLs and hashtags.
+func findInlineEntities(text []rune) []*Entity {
+	var entities []*Entity
+
+	for i := 0; i < len(text); i++ {
+		if i > 0 && (isWordRune(text[i-1]) || text[i-1] == '@' || text[i-1] == '#') {
+			continue
+		}
+
+		switch {
+		case text[i] == '@' || text[i] == '#':
+			end := i + 1
+			for end < len(text) && isWordRune(text[end]) {
+				end++
+			}
+			if end == i+1 {
+				continue
+			}
+
+			e := &Entity{Offset: i, Length: end - i}
+			if text[i] == '@' {
+				e.Type = EntityMention
+				e.Nickname = string(text[i+1 : end])
+			} else {
+				e.Type = EntityHashtag
+			}
+			entities = append(entities, e)
+			i = end - 1
+
+		case hasURLPrefix(text[i:]):
+			end := i
+			for end < len(text) && !unicode.IsSpace(text[end]) {
+				end++
+			}
+			// Punctuation ending a sentence is not part of the link.
+			for end > i && strings.ContainsRune(".,:;!?)'\"", text[end-1]) {
+				end--
+			}
+
+			url := string(text[i:end])
+			entities = append(entities, &Entity{
+				Type:   EntityURL,
+				Offset: i,
+				Length: end - i,
+				URL:    url,
+			})
+			i = end - 1
+		}
+	}
+
+	return entities
+}
+
+func hasURLPrefix(text []rune) bool {
+	if len(text) > 8 {
+		text = text[:8]
+	}
+
+	s := strings.ToLower(string(text))
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+func overlapsAny(e *Entity, others []*Entity) bool {
+	for _, o := range others {
+		if e.Offset < o.Offset+o.Length && o.Offset < e.Offset+e.Length {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sortEntities(entities []*Entity) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Offset < entities[j].Offset
+	})
+}
+
+// Mentions returns the users mentioned in the message.
+func (m *Message) Mentions() []primitive.ObjectID {
+	var result []primitive.ObjectID
+	seen := make(map[primitive.ObjectID]bool)
+	for _, e := range m.Entities {
+		if e.Type == EntityMention && e.UserID != nil && !seen[*e.UserID] {
+			seen[*e.UserID] = true
+			result = append(result, *e.UserID)
+		}
+	}
+
+	return result
+}
+
+// FirstURL returns the first link of the message, for its preview.
+func (m *Message) FirstURL() string {
+	for _, e := range m.Entities {
+		if e.Type == EntityURL {
+			return e.URL
+		}
+	}
+
+	return ""
+}
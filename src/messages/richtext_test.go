@@ -0,0 +1,114 @@
+package messages
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		text     string
+		entities []*Entity
+	}{
+		{
+			name: "plain",
+			raw:  "hello there",
+			text: "hello there",
+		},
+		{
+			name: "bold and italic",
+			raw:  "a *bold* and _italic_ word",
+			text: "a bold and italic word",
+			entities: []*Entity{
+				{Type: EntityBold, Offset: 2, Length: 4},
+				{Type: EntityItalic, Offset: 11, Length: 6},
+			},
+		},
+		{
+			name: "nested",
+			raw:  "*very _much_ so*",
+			text: "very much so",
+			entities: []*Entity{
+				{Type: EntityBold, Offset: 0, Length: 12},
+				{Type: EntityItalic, Offset: 5, Length: 4},
+			},
+		},
+		{
+			name: "markers inside words",
+			raw:  "snake_case_name and 2*3*4",
+			text: "snake_case_name and 2*3*4",
+		},
+		{
+			name: "unclosed",
+			raw:  "*not bold",
+			text: "*not bold",
+		},
+		{
+			name: "not across lines",
+			raw:  "*one\ntwo*",
+			text: "*one\ntwo*",
+		},
+		{
+			name: "code hides markup and mentions",
+			raw:  "run `*x* @bob` now",
+			text: "run *x* @bob now",
+			entities: []*Entity{
+				{Type: EntityCode, Offset: 4, Length: 8},
+			},
+		},
+		{
+			name: "mention and hashtag",
+			raw:  "hi @bob_1, see #news",
+			text: "hi @bob_1, see #news",
+			entities: []*Entity{
+				{Type: EntityMention, Offset: 3, Length: 6, Nickname: "bob_1"},
+				{Type: EntityHashtag, Offset: 15, Length: 5},
+			},
+		},
+		{
+			name: "no mention inside an address",
+			raw:  "mail bob@example.com",
+			text: "mail bob@example.com",
+		},
+		{
+			name: "url without trailing punctuation",
+			raw:  "look at https://example.com/a?b=1.",
+			text: "look at https://example.com/a?b=1.",
+			entities: []*Entity{
+				{Type: EntityURL, Offset: 8, Length: 25, URL: "https://example.com/a?b=1"},
+			},
+		},
+		{
+			name: "offsets in runes",
+			raw:  "привет *мир* @bob",
+			text: "привет мир @bob",
+			entities: []*Entity{
+				{Type: EntityBold, Offset: 7, Length: 3},
+				{Type: EntityMention, Offset: 11, Length: 4, Nickname: "bob"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, entities := ParseText(tt.raw)
+			if text != tt.text {
+				t.Errorf("text = %q, want %q", text, tt.text)
+			}
+			if !reflect.DeepEqual(entities, tt.entities) {
+				t.Errorf("entities = %+v, want %+v", describe(entities), describe(tt.entities))
+			}
+		})
+	}
+}
+
+func describe(entities []*Entity) []Entity {
+	result := []Entity{}
+	for _, e := range entities {
+		result = append(result, *e)
+	}
+
+	return result
+}
@@ -0,0 +1,206 @@
+package messages
+
+import (
+	"context"
+	"strings"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// snippetRadius is the number of runes kept around the first match.
+const snippetRadius = 40
+
+// SearchQuery finds messages of ChatIDs matching Text, newest first. The
+// other fields narrow the search down and are ignored when zero. After and
+// Before are unix nano timestamps.
+type SearchQuery struct {
+	Viewer        primitive.ObjectID
+	ChatIDs       []primitive.ObjectID
+	Text          string
+	From          primitive.ObjectID
+	After         int64
+	Before        int64
+	HasAttachment bool
+	Cursor        *Cursor
+	Limit         int
+}
+
+// Highlight is a match within a snippet, in runes.
+type Highlight struct {
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+type SearchResult struct {
+	Message    *Message     `json:"message"`
+	Snippet    string       `json:"snippet"`
+	Highlights []*Highlight `json:"highlights"`
+}
+
+// SearchPage is a page of search results, NextCursor continues with older
+// messages and is empty on the last page.
+type SearchPage struct {
+	Results    []*SearchResult `json:"results"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+// Search runs a text search over the messages, see SearchQuery. Words are
+// matched whole and case insensitively.
+func (dao *DAO) Search(ctx context.Context, query *SearchQuery) (*SearchPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+
+	page := &SearchPage{Results: []*SearchResult{}}
+	if len(query.ChatIDs) == 0 {
+		return page, nil
+	}
+
+	filter := bson.D{
+		{"$text", bson.D{{"$search", query.Text}}},
+		{"chatId", bson.D{{"$in", query.ChatIDs}}},
+		{"deleted", bson.D{{"$ne", true}}},
+		{"hiddenFor", bson.D{{"$ne", query.Viewer}}},
+	}
+
+	if !query.From.IsZero() {
+		filter = append(filter, bson.E{"from", query.From})
+	}
+
+	if query.HasAttachment {
+		filter = append(filter, bson.E{"attachmentLink", bson.D{{"$exists", true}}})
+	}
+
+	timeRange := bson.D{}
+	if query.After != 0 {
+		timeRange = append(timeRange, bson.E{"$gt", query.After})
+	}
+	if query.Before != 0 {
+		timeRange = append(timeRange, bson.E{"$lt", query.Before})
+	}
+	if len(timeRange) > 0 {
+		filter = append(filter, bson.E{"time", timeRange})
+	}
+
+	if c := query.Cursor; c != nil {
+		filter = append(filter, bson.E{"$or", bson.A{
+			bson.D{{"time", bson.D{{"$lt", c.Time}}}},
+			bson.D{{"time", c.Time}, {"_id", bson.D{{"$lt", c.ID}}}},
+		}})
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{"time", -1}, {"_id", -1}}).
+		SetLimit(int64(limit + 1))
+
+	cursor, err := dao.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []*Message
+	if err := cursor.All(ctx, &msgs); err != nil {
+		return nil, err
+	}
+
+	if len(msgs) > limit {
+		msgs = msgs[:limit]
+		page.NextCursor = CursorOf(msgs[len(msgs)-1]).String()
+	}
+
+	terms := searchTerms(query.Text)
+	for _, msg := range msgs {
+		snippet, highlights := Snippet(msg.Text, terms)
+		page.Results = append(page.Results, &SearchResult{
+			Message:    msg,
+			Snippet:    snippet,
+			Highlights: highlights,
+		})
+	}
+
+	return page, nil
+}
+
+// searchTerms splits a search string into lower case words, dropping the
+// quotes and minus signs of the text search syntax.
+func searchTerms(text string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(text, isWordSeparator) {
+		terms = append(terms, strings.ToLower(word))
+	}
+
+	return terms
+}
+
+func isWordSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// Snippet cuts the part of text around the first word matching one of
+// terms and returns it with the positions of every matching word in it.
+func Snippet(text string, terms []string) (string, []*Highlight) {
+	runes := []rune(text)
+
+	type word struct{ start, end int }
+	var matches []word
+	start := -1
+	for i := 0; i <= len(runes); i++ {
+		if i < len(runes) && !isWordSeparator(runes[i]) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+
+		w := strings.ToLower(string(runes[start:i]))
+		for _, term := range terms {
+			if w == term {
+				matches = append(matches, word{start, i})
+				break
+			}
+		}
+		start = -1
+	}
+
+	from, to := 0, len(runes)
+	if len(matches) > 0 {
+		if matches[0].start > snippetRadius {
+			from = matches[0].start - snippetRadius
+		}
+		if matches[0].end+snippetRadius < to {
+			to = matches[0].end + snippetRadius
+		}
+	} else if to > 2*snippetRadius {
+		to = 2 * snippetRadius
+	}
+
+	highlights := []*Highlight{}
+	for _, m := range matches {
+		if m.start >= from && m.end <= to {
+			highlights = append(highlights, &Highlight{Offset: m.start - from, Length: m.end - m.start})
+		}
+	}
+
+	snippet := string(runes[from:to])
+	if from > 0 {
+		snippet = "…" + snippet
+		for _, h := range highlights {
+			h.Offset++
+		}
+	}
+	if to < len(runes) {
+		snippet += "…"
+	}
+
+	return snippet, highlights
+}
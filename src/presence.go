@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"uberMessenger/src/hub"
+	"uberMessenger/src/users"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// presenceHeartbeat is how often the presence of connected users is
+	// refreshed in the database. Presence not refreshed for presenceTimeout
+	// belongs to a server that went away, the user is offline.
+	presenceHeartbeat = time.Minute
+	presenceTimeout   = 3 * presenceHeartbeat
+
+	// typingTTL ends a typing indicator the client did not stop or renew,
+	// e.g. because it lost its connection.
+	typingTTL = 6 * time.Second
+
+	// maxPresenceBatch caps the number of users in a presence query.
+	maxPresenceBatch = 100
+)
+
+type PresencePayload struct {
+	UserID   primitive.ObjectID `json:"userId"`
+	State    string             `json:"state"`
+	LastSeen int64              `json:"lastSeen,omitempty"`
+}
+
+// PresenceParams is sent by clients with presence.set, State is online or
+// away.
+type PresenceParams struct {
+	State string `json:"state"`
+}
+
+type TypingPayload struct {
+	ChatID primitive.ObjectID `json:"chatId"`
+	UserID primitive.ObjectID `json:"userId"`
+	Typing bool               `json:"typing"`
+}
+
+type TypingParams struct {
+	ChatID string `json:"chatId"`
+}
+
+type typingKey struct {
+	userID primitive.ObjectID
+	chatID primitive.ObjectID
+}
+
+// typingTimers expire the typing indicators started on this instance.
+type typingTimers struct {
+	mu     sync.Mutex
+	timers map[typingKey]*time.Timer
+}
+
+func newTypingTimers() *typingTimers {
+	return &typingTimers{timers: make(map[typingKey]*time.Timer)}
+}
+
+// start (re)arms the timer of key and reports whether it was not running.
+func (t *typingTimers) start(key typingKey, expire func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if timer, ok := t.timers[key]; ok && timer.Stop() {
+		timer.Reset(typingTTL)
+		return false
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(typingTTL, func() {
+		t.mu.Lock()
+		current := t.timers[key] == timer
+		if current {
+			delete(t.timers, key)
+		}
+		t.mu.Unlock()
+
+		if current {
+			expire()
+		}
+	})
+	t.timers[key] = timer
+
+	return true
+}
+
+// stop cancels the timer of key and reports whether it was running.
+func (t *typingTimers) stop(key typingKey) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	timer, ok := t.timers[key]
+	if !ok {
+		return false
+	}
+	delete(t.timers, key)
+
+	return timer.Stop()
+}
+
+// stopUser cancels every timer of the user and returns their chats.
+func (t *typingTimers) stopUser(userID primitive.ObjectID) []primitive.ObjectID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var chatIDs []primitive.ObjectID
+	for key, timer := range t.timers {
+		if key.userID == userID {
+			delete(t.timers, key)
+			if timer.Stop() {
+				chatIDs = append(chatIDs, key.chatID)
+			}
+		}
+	}
+
+	return chatIDs
+}
+
+// setTyping tells the other members of the chat that the user started or
+// stopped typing. A started indicator ends by itself after typingTTL unless
+// the client repeats typing.start.
+func (e *Endpoints) setTyping(ctx context.Context, userID, chatID primitive.ObjectID, typing bool) error {
+	_, err := e.authorizeChat(ctx, userID, chatID)
+	if err != nil {
+		return err
+	}
+
+	key := typingKey{userID: userID, chatID: chatID}
+	if typing {
+		started := e.typing.start(key, func() {
+			e.publishTyping(context.Background(), userID, chatID, false)
+		})
+		if !started {
+			return nil
+		}
+	} else if !e.typing.stop(key) {
+		return nil
+	}
+
+	return e.publishTyping(ctx, userID, chatID, typing)
+}
+
+func (e *Endpoints) publishTyping(ctx context.Context, userID, chatID primitive.ObjectID, typing bool) error {
+	chat, err := e.ChatDAO.GetChatByID(ctx, chatID)
+	if err != nil {
+		return err
+	}
+
+	var others []primitive.ObjectID
+	for _, id := range chat.Users {
+		if id != userID {
+			others = append(others, id)
+		}
+	}
+
+	err = e.hub.Publish(others, hub.EventTyping, &TypingPayload{
+		ChatID: chatID,
+		UserID: userID,
+		Typing: typing,
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+
+	return err
+}
+
+// presenceChanged stores the user's presence on this instance, combines it
+// with their presence on the other instances and tells the members of their
+// chats. Typing started here stops when the user leaves this instance.
+func (e *Endpoints) presenceChanged(userID primitive.ObjectID) {
+	ctx := context.Background()
+	local := e.hub.Presence(userID)
+	now := time.Now()
+
+	if local == hub.PresenceOffline {
+		for _, chatID := range e.typing.stopUser(userID) {
+			e.publishTyping(ctx, userID, chatID, false)
+		}
+	}
+
+	state, err := e.storePresence(ctx, userID, local, now)
+	if err != nil {
+		log.Printf("Presence error: %s", err)
+		return
+	}
+
+	contacts, err := e.contactsOf(ctx, userID)
+	if err != nil {
+		log.Printf("Presence error: %s", err)
+		return
+	}
+
+	err = e.hub.Publish(contacts, hub.EventPresence, &PresencePayload{
+		UserID:   userID,
+		State:    state,
+		LastSeen: now.UnixNano(),
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+// storePresence records the user's presence on this instance and stores
+// the presence combined over every instance, which it returns.
+func (e *Endpoints) storePresence(ctx context.Context, userID primitive.ObjectID, local string, now time.Time) (string, error) {
+	var err error
+	if local == hub.PresenceOffline {
+		err = e.UserDAO.RemoveInstancePresence(ctx, userID, e.instanceID)
+	} else {
+		err = e.UserDAO.SetInstancePresence(ctx, userID, e.instanceID, local, now)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	instances, err := e.UserDAO.GetInstancePresence(ctx, userID, now.Add(-presenceTimeout))
+	if err != nil {
+		return "", err
+	}
+
+	state := combinePresence(instances)
+	err = e.UserDAO.SetPresence(ctx, userID, state, now.UnixNano())
+	if err != nil {
+		return "", err
+	}
+
+	return state, nil
+}
+
+// combinePresence makes a user online if they are online on any instance,
+// away if they are connected but away everywhere and offline otherwise.
+func combinePresence(instances []*users.InstancePresence) string {
+	state := hub.PresenceOffline
+	for _, instance := range instances {
+		switch instance.State {
+		case hub.PresenceOnline:
+			return hub.PresenceOnline
+		case hub.PresenceAway:
+			state = hub.PresenceAway
+		}
+	}
+
+	return state
+}
+
+// refreshPresence keeps the presence of the users connected to this
+// instance from going stale.
+func (e *Endpoints) refreshPresence() {
+	for range time.Tick(presenceHeartbeat) {
+		ctx := context.Background()
+		now := time.Now()
+
+		for _, userID := range e.hub.OnlineUsers() {
+			_, err := e.storePresence(ctx, userID, e.hub.Presence(userID), now)
+			if err != nil {
+				log.Printf("Presence error: %s", err)
+			}
+		}
+	}
+}
+
+// contactsOf returns the users sharing a chat with userID.
+func (e *Endpoints) contactsOf(ctx context.Context, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	userChats, err := e.ChatDAO.GetChatsByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[primitive.ObjectID]bool{userID: true}
+	var result []primitive.ObjectID
+	for _, chat := range userChats {
+		for _, id := range chat.Users {
+			if !seen[id] {
+				seen[id] = true
+				result = append(result, id)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// presenceOf reads the presence of a user as last combined by one of the
+// instances they are connected to.
+func presenceOf(user *users.User) *PresencePayload {
+	payload := &PresencePayload{
+		UserID:   user.ID,
+		State:    user.Presence,
+		LastSeen: user.LastSeen,
+	}
+
+	stale := time.Since(time.Unix(0, user.LastSeen)) > presenceTimeout
+	if payload.State == "" || stale {
+		payload.State = hub.PresenceOffline
+	}
+
+	return payload
+}
+
+// GetPresence returns the presence of the users listed in ids, separated by
+// commas. Only users sharing a chat with the caller are reported.
+func (e *Endpoints) GetPresence(w http.ResponseWriter, r *http.Request) {
+	e.writeHeaders(w)
+	ctx := context.TODO()
+	userID := userIDFromContext(r.Context())
+
+	var ids []primitive.ObjectID
+	for _, value := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if value == "" {
+			continue
+		}
+
+		id, err := primitive.ObjectIDFromHex(value)
+		if err != nil {
+			e.handleError(w, fmt.Errorf("%w: %s", errBadRequest, err))
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	if len(ids) > maxPresenceBatch {
+		e.handleError(w, fmt.Errorf("%w: more than %d users", errBadRequest, maxPresenceBatch))
+		return
+	}
+
+	contacts, err := e.contactsOf(ctx, userID)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	visible := map[primitive.ObjectID]bool{userID: true}
+	for _, id := range contacts {
+		visible[id] = true
+	}
+
+	var allowed []primitive.ObjectID
+	for _, id := range ids {
+		if visible[id] {
+			allowed = append(allowed, id)
+		}
+	}
+
+	result := []*PresencePayload{}
+	if len(allowed) > 0 {
+		found, err := e.UserDAO.GetUsersByIDs(ctx, allowed)
+		if err != nil {
+			e.handleError(w, err)
+			return
+		}
+
+		for _, user := range found {
+			result = append(result, presenceOf(user))
+		}
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		e.handleError(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write(bytes)
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"uberMessenger/src/auth"
+	"uberMessenger/src/hub"
+	"uberMessenger/src/messages"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MessageAckParams reports that the messages reached one of the user's
+// devices (delivered) or were shown to them (read).
+type MessageAckParams struct {
+	MessageIDs []string `json:"messageIds"`
+	State      string   `json:"state"`
+}
+
+// MessageStatusPayload tells the sender that the message reached State for
+// UserID. Status is the aggregated state over all recipients.
+type MessageStatusPayload struct {
+	MessageID primitive.ObjectID `json:"messageId"`
+	ChatID    primitive.ObjectID `json:"chatId"`
+	UserID    primitive.ObjectID `json:"userId"`
+	State     string             `json:"state"`
+	Status    string             `json:"status"`
+}
+
+// MessagesReadPayload tells senders that UserID read their messages on the
+// main timeline of the chat up to Time.
+type MessagesReadPayload struct {
+	ChatID primitive.ObjectID `json:"chatId"`
+	UserID primitive.ObjectID `json:"userId"`
+	Time   int64              `json:"time"`
+}
+
+const (
+	// maxAckBatch caps the number of messages acked by one command.
+	maxAckBatch = 100
+
+	// maxReadBatch caps the messages whose delivery is marked read when a
+	// read marker moves.
+	maxReadBatch = 500
+)
+
+var errUnknownCommand = errors.New("unknown command")
+
+func (e *Endpoints) processMessages() {
+	for {
+		msg := <-e.msgChannel
+		event, err := newMessageEvent(msg)
+		if err != nil {
+			log.Printf("Websocket error: %s", err)
+			continue
+		}
+
+		err = e.hub.PublishEvent(event)
+		if err != nil {
+			log.Printf("Websocket error: %s", err)
+		}
+	}
+}
+
+func (e *Endpoints) processChats() {
+	for {
+		chat := <-e.chatChannel
+		err := e.hub.Publish(chat.Users, hub.EventChatCreated, chat)
+		if err != nil {
+			log.Printf("Websocket error: %s", err)
+		}
+	}
+}
+
+// messageEventType tells whether msg goes to the main timeline or to a
+// thread.
+func messageEventType(msg *messages.Message) string {
+	if msg.ThreadRootID != nil {
+		return hub.EventThreadReplyCreated
+	}
+
+	return hub.EventMessageCreated
+}
+
+func newMessageEvent(msg *messages.Message) (*hub.Event, error) {
+	event, err := hub.NewEvent(messageEventType(msg), msg)
+	if err != nil {
+		return nil, err
+	}
+	event.ChatID = msg.ChatID
+
+	return event, nil
+}
+
+// chatMembers resolves the recipients of events addressed to a chat.
+func (e *Endpoints) chatMembers(ctx context.Context, chatID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	chat, err := e.ChatDAO.GetChatByID(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+
+	return chat.Users, nil
+}
+
+// newMongoBackplane fans events out through a change stream so that every
+// replica delivers the events published by any other one. Every event goes
+// through the hub.EventsCollectionName collection, together with the seqs
+// given to it at publication.
+func newMongoBackplane(ctx context.Context, client *mongo.Client) (*hub.MongoBackplane, error) {
+	return hub.NewMongoBackplane(ctx, client.Database(messages.DBName))
+}
+
+// SocketHandler serves the realtime connection. Events and commands are
+// wrapped in hub.Envelope, see the hub package for their types.
+//
+// A reconnecting client passes the seq up to which it has seen every event
+// as cursor. Events it missed are replayed from its event log before live
+// delivery starts. Every connection is told the cursor to continue from, a
+// new one through replay.done right away.
+func (e *Endpoints) SocketHandler(w http.ResponseWriter, r *http.Request) {
+	ws, userID, cursor, err := e.upgradeSocket(w, r)
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+		return
+	}
+
+	c := e.hub.RegisterPaused(userID, ws)
+	go e.replay(c, cursor)
+}
+
+// replay sends the events logged for the user after cursor and then resumes
+// live delivery. If too much was missed, or the log no longer reaches back
+// to cursor, the client is told to resync over REST instead. Without a
+// cursor there is nothing to replay.
+func (e *Endpoints) replay(c *hub.Conn, cursor int64) {
+	ctx := context.Background()
+
+	if cursor != 0 {
+		events, err := e.missedEvents(ctx, c.UserID, cursor)
+		if err != nil {
+			log.Printf("Websocket replay error: %s", err)
+		}
+
+		if events != nil {
+			// The cursor stops before a seq still missing from the log,
+			// its event may yet arrive live.
+			last := cursor
+			for _, event := range events {
+				c.SendReplayed(event.Type, event.Seq, event.Payload)
+				if event.Seq == last+1 {
+					last = event.Seq
+				}
+			}
+
+			c.SendEvent(hub.EventReplayDone, "", &hub.ReplayPayload{Cursor: last})
+			c.Resume(last)
+			return
+		}
+	}
+
+	// The client starts over from the current state, which already
+	// includes the events up to the last seq.
+	last, err := e.eventLog.LastSeq(ctx, c.UserID)
+	if err != nil {
+		log.Printf("Websocket replay error: %s", err)
+		c.Close()
+		return
+	}
+
+	eventType := hub.EventReplayDone
+	if cursor != 0 {
+		eventType = hub.EventResync
+	}
+
+	c.SendEvent(eventType, "", &hub.ReplayPayload{Cursor: last})
+	c.Resume(last)
+}
+
+// missedEvents returns the events of the user after cursor, or nil if they
+// cannot all be replayed.
+func (e *Endpoints) missedEvents(ctx context.Context, userID primitive.ObjectID, cursor int64) ([]*hub.LoggedEvent, error) {
+	events, err := e.eventLog.After(ctx, userID, cursor, replayLimit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(events) > replayLimit {
+		return nil, nil
+	}
+
+	if len(events) == 0 {
+		// A cursor past the log comes from elsewhere.
+		last, err := e.eventLog.LastSeq(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if cursor > last {
+			return nil, nil
+		}
+
+		return []*hub.LoggedEvent{}, nil
+	}
+
+	// The events right after the cursor expired or never made it to the log.
+	if events[0].Seq != cursor+1 {
+		return nil, nil
+	}
+
+	return events, nil
+}
+
+// handleCommand dispatches commands received over the socket. The returned
+// value is sent back to the client in an ack.
+func (e *Endpoints) handleCommand(c *hub.Conn, env *hub.Envelope) (interface{}, error) {
+	ctx := context.Background()
+
+	switch env.Type {
+	case hub.CommandSendMessage:
+		var params AddMessageParams
+		if err := json.Unmarshal(env.Payload, &params); err != nil {
+			return nil, err
+		}
+
+		return e.createMessage(ctx, c.UserID, &params)
+
+	case hub.CommandAckMessages:
+		var params MessageAckParams
+		if err := json.Unmarshal(env.Payload, &params); err != nil {
+			return nil, err
+		}
+
+		return nil, e.ackMessages(ctx, c.UserID, &params)
+
+	case hub.CommandTypingStart, hub.CommandTypingStop:
+		var params TypingParams
+		if err := json.Unmarshal(env.Payload, &params); err != nil {
+			return nil, err
+		}
+
+		chatID, err := primitive.ObjectIDFromHex(params.ChatID)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, e.setTyping(ctx, c.UserID, chatID, env.Type == hub.CommandTypingStart)
+
+	case hub.CommandPresenceSet:
+		var params PresenceParams
+		if err := json.Unmarshal(env.Payload, &params); err != nil {
+			return nil, err
+		}
+
+		switch params.State {
+		case hub.PresenceOnline, hub.PresenceAway:
+			e.hub.SetAway(c, params.State == hub.PresenceAway)
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("%w: unknown presence %q", errBadRequest, params.State)
+		}
+
+	case hub.CommandDraftSave:
+		var params DraftParams
+		if err := json.Unmarshal(env.Payload, &params); err != nil {
+			return nil, err
+		}
+
+		return e.saveDraft(ctx, c.UserID, &params, c)
+
+	default:
+		return nil, errUnknownCommand
+	}
+}
+
+// ackMessages moves the user's delivery state of the messages forward.
+// Messages already in that state are skipped, so acks can be repeated.
+func (e *Endpoints) ackMessages(ctx context.Context, userID primitive.ObjectID, params *MessageAckParams) error {
+	if err := messages.ValidateAckStatus(params.State); err != nil {
+		return err
+	}
+
+	if len(params.MessageIDs) > maxAckBatch {
+		return fmt.Errorf("%w: more than %d messages", errBadRequest, maxAckBatch)
+	}
+
+	for _, id := range params.MessageIDs {
+		msg, err := e.authorizeMessage(ctx, userID, id)
+		if err != nil {
+			return err
+		}
+
+		if msg.DeliveryFor(userID) == nil {
+			continue
+		}
+
+		msg, err = e.MessageDAO.SetDeliveryState(ctx, msg.ID, userID, params.State)
+		if err == messages.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		e.publishStatus(msg, userID)
+	}
+
+	return nil
+}
+
+// markReadUpTo marks the deliveries of the messages read with a read marker
+// and tells their senders once each.
+func (e *Endpoints) markReadUpTo(ctx context.Context, chatID, userID primitive.ObjectID, upTo int64) {
+	senders, err := e.MessageDAO.MarkReadUpTo(ctx, chatID, userID, upTo, maxReadBatch)
+	if err != nil {
+		log.Printf("Delivery status error: %s", err)
+		return
+	}
+
+	err = e.hub.Publish(senders, hub.EventMessagesRead, &MessagesReadPayload{
+		ChatID: chatID,
+		UserID: userID,
+		Time:   upTo,
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+// publishStatus tells the sender of msg that its delivery to userID changed.
+func (e *Endpoints) publishStatus(msg *messages.Message, userID primitive.ObjectID) {
+	delivery := msg.DeliveryFor(userID)
+	if delivery == nil {
+		return
+	}
+
+	msg.AggregateStatus()
+	err := e.hub.Publish([]primitive.ObjectID{msg.From}, hub.EventMessageStatus, &MessageStatusPayload{
+		MessageID: msg.ID,
+		ChatID:    msg.ChatID,
+		UserID:    userID,
+		State:     delivery.State,
+		Status:    msg.Status,
+	})
+	if err != nil {
+		log.Printf("Websocket error: %s", err)
+	}
+}
+
+const (
+	// bearerProtocol lets browsers pass the token as the second value of
+	// Sec-WebSocket-Protocol, since they cannot set an Authorization header.
+	bearerProtocol = "bearer"
+
+	socketAuthTimeout = 10 * time.Second
+
+	// replayLimit caps the number of events replayed on reconnect.
+	replayLimit = 500
+)
+
+type SocketAuthParams struct {
+	Type   string `json:"type"`
+	Token  string `json:"token"`
+	Cursor int64  `json:"cursor,omitempty"`
+}
+
+// upgradeSocket authenticates a websocket client and returns the socket bound
+// to the token's user. The token is taken from the token query parameter,
+// from Sec-WebSocket-Protocol ("bearer", token) or, if neither is set, from
+// an {"type": "auth", "token": ..., "cursor": ...} message that must be the
+// first frame. The replay cursor is read from the cursor query parameter or
+// from the auth message.
+// Errors are already reported to the client.
+func (e *Endpoints) upgradeSocket(w http.ResponseWriter, r *http.Request) (*websocket.Conn, primitive.ObjectID, int64, error) {
+	ctx := r.Context()
+
+	var cursor int64
+	if value := r.URL.Query().Get("cursor"); value != "" {
+		var err error
+		cursor, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			e.handleError(w, err)
+			return nil, primitive.ObjectID{}, 0, err
+		}
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		protocols := websocket.Subprotocols(r)
+		if len(protocols) == 2 && protocols[0] == bearerProtocol {
+			token = protocols[1]
+		}
+	}
+
+	var userID primitive.ObjectID
+	if token != "" {
+		claims, err := e.validateToken(ctx, token)
+		if err != nil {
+			e.handleError(w, err)
+			return nil, primitive.ObjectID{}, 0, err
+		}
+
+		userID, err = claims.User()
+		if err != nil {
+			e.handleError(w, errUnauthorized)
+			return nil, primitive.ObjectID{}, 0, err
+		}
+	}
+
+	ws, err := e.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, primitive.ObjectID{}, 0, err
+	}
+
+	if token != "" {
+		return ws, userID, cursor, nil
+	}
+
+	ws.SetReadDeadline(time.Now().Add(socketAuthTimeout))
+	var params SocketAuthParams
+	err = ws.ReadJSON(&params)
+	if err == nil && params.Type != "auth" {
+		err = errUnauthorized
+	}
+
+	var claims *auth.Claims
+	if err == nil {
+		claims, err = e.validateToken(ctx, params.Token)
+	}
+	if err == nil {
+		userID, err = claims.User()
+	}
+	if err != nil {
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"),
+			time.Now().Add(time.Second))
+		ws.Close()
+		return nil, primitive.ObjectID{}, 0, err
+	}
+
+	ws.SetReadDeadline(time.Time{})
+
+	if params.Cursor != 0 {
+		cursor = params.Cursor
+	}
+
+	return ws, userID, cursor, nil
+}
+
+// originChecker allows websocket connections from the listed origins only.
+// "*" allows every origin; an empty list falls back to same-origin checks.
+func originChecker(allowedOrigins []string) func(r *http.Request) bool {
+	if len(allowedOrigins) == 0 {
+		return nil
+	}
+
+	allowed := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		allowed[strings.TrimRight(strings.TrimSpace(origin), "/")] = true
+	}
+
+	return func(r *http.Request) bool {
+		if allowed["*"] {
+			return true
+		}
+
+		origin := r.Header.Get("Origin")
+		// Non-browser clients do not send an Origin header.
+		return origin == "" || allowed[origin]
+	}
+}
@@ -0,0 +1,124 @@
+package receipts
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+const (
+	DBName         = "messenger"
+	CollectionName = "readMarkers"
+)
+
+// ErrNotAdvanced is returned when a marker is already at or past the
+// requested position.
+var ErrNotAdvanced = errors.New("read marker is already further")
+
+type DAO struct {
+	client     *mongo.Client
+	db         *mongo.Database
+	collection *mongo.Collection
+}
+
+func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
+	db := client.Database(DBName)
+	collection := db.Collection(CollectionName)
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Options: options.Index().SetUnique(true),
+		Keys: bsonx.Doc{
+			{"chatId", bsonx.Int32(1)},
+			{"userId", bsonx.Int32(1)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DAO{
+		client:     client,
+		db:         db,
+		collection: collection,
+	}, nil
+}
+
+// GetMarker returns the user's marker in the chat or nil if they have not
+// read anything there yet.
+func (dao *DAO) GetMarker(ctx context.Context, userID, chatID primitive.ObjectID) (*ReadMarker, error) {
+	filter := bson.D{{"chatId", chatID}, {"userId", userID}}
+
+	var marker *ReadMarker
+	err := dao.collection.FindOne(ctx, filter).Decode(&marker)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return marker, nil
+}
+
+// GetMarkersByChat returns the markers of every member who has read
+// something in the chat.
+func (dao *DAO) GetMarkersByChat(ctx context.Context, chatID primitive.ObjectID) ([]*ReadMarker, error) {
+	filter := bson.D{{"chatId", chatID}}
+
+	cursor, err := dao.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*ReadMarker{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// MarkRead moves the user's marker in the chat forward to the message sent
+// at msgTime. Markers never move back, ErrNotAdvanced is returned if it was
+// already there.
+func (dao *DAO) MarkRead(ctx context.Context, userID, chatID, msgID primitive.ObjectID, msgTime int64) (*ReadMarker, error) {
+	filter := bson.D{{"chatId", chatID}, {"userId", userID}}
+	insert := bson.D{{"$setOnInsert", bson.D{
+		{"_id", primitive.NewObjectID()},
+		{"time", int64(0)},
+	}}}
+
+	_, err := dao.collection.UpdateOne(ctx, filter, insert, options.Update().SetUpsert(true))
+	if err != nil {
+		return nil, err
+	}
+
+	filter = append(filter, bson.E{"time", bson.D{{"$lt", msgTime}}})
+	update := bson.D{{"$set", bson.D{
+		{"messageId", msgID},
+		{"time", msgTime},
+		{"readAt", time.Now().UnixNano()},
+	}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var marker *ReadMarker
+	err = dao.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&marker)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotAdvanced
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return marker, nil
+}
+
+func (dao *DAO) Drop(ctx context.Context) error {
+	return dao.collection.Drop(ctx)
+}
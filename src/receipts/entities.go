@@ -0,0 +1,16 @@
+package receipts
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ReadMarker is the position up to which a user has read a chat. Messages
+// up to Time are read, ReadAt is when the marker last moved.
+type ReadMarker struct {
+	ID        primitive.ObjectID `bson:"_id" json:"-"`
+	UserID    primitive.ObjectID `bson:"userId" json:"userId"`
+	ChatID    primitive.ObjectID `bson:"chatId" json:"chatId"`
+	MessageID primitive.ObjectID `bson:"messageId" json:"messageId"`
+	Time      int64              `bson:"time" json:"time"`
+	ReadAt    int64              `bson:"readAt" json:"readAt"`
+}
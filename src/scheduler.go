@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"uberMessenger/src/hub"
+	"uberMessenger/src/messages"
+)
+
+const (
+	// schedulerInterval is how often scheduled and expired messages are
+	// looked for. Both are persisted, so nothing is lost over a restart.
+	schedulerInterval = time.Second
+
+	// scheduleClaim is how long an instance has to send a scheduled message
+	// before another one may try.
+	scheduleClaim = 30 * time.Second
+
+	// reapBatch caps the expired messages deleted, or the polls closed, per
+	// round.
+	reapBatch = 100
+)
+
+// sendScheduled sends the scheduled messages that are due, on whichever
+// instance claims them first.
+func (e *Endpoints) sendScheduled() {
+	for range time.Tick(schedulerInterval) {
+		ctx := context.Background()
+
+		for {
+			scheduled, err := e.MessageDAO.ClaimScheduledMessage(ctx, time.Now().UnixNano(), scheduleClaim)
+			if err != nil {
+				log.Printf("Scheduler error: %s", err)
+				break
+			}
+			if scheduled == nil {
+				break
+			}
+
+			e.sendScheduledMessage(ctx, scheduled)
+		}
+	}
+}
+
+func (e *Endpoints) sendScheduledMessage(ctx context.Context, scheduled *messages.ScheduledMessage) {
+	msg := scheduled.Message
+	msg.Time = time.Now().UnixNano()
+	for _, d := range msg.Deliveries {
+		d.Time = msg.Time
+	}
+
+	// The quoted message may have been deleted in the meantime, and the
+	// sender may have left the chat.
+	err := e.dropDeletedQuote(ctx, msg)
+	if err == nil {
+		_, err = e.authorizeChat(ctx, msg.From, msg.ChatID)
+	}
+	if err == nil {
+		err = e.sendMessage(ctx, msg)
+	}
+	if err == errForbidden || err == messages.ErrDuplicate {
+		err = nil
+	}
+	if err != nil {
+		// The claim runs out and the message is retried.
+		log.Printf("Scheduler error: %s", err)
+		return
+	}
+
+	err = e.MessageDAO.RemoveScheduledMessage(ctx, scheduled.ID)
+	if err != nil {
+		log.Printf("Scheduler error: %s", err)
+	}
+}
+
+// dropDeletedQuote removes the quote of msg if the quoted message is gone.
+func (e *Endpoints) dropDeletedQuote(ctx context.Context, msg *messages.Message) error {
+	if msg.Quote == nil || msg.ReplyTo == nil {
+		return nil
+	}
+
+	original, err := e.MessageDAO.GetMessageByID(ctx, *msg.ReplyTo)
+	if err == messages.ErrNotFound {
+		msg.Quote = nil
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if original.Deleted {
+		msg.Quote = nil
+	}
+
+	return nil
+}
+
+// reapExpired deletes self-destructing messages once they expire and tells
+// the chats.
+func (e *Endpoints) reapExpired() {
+	for range time.Tick(schedulerInterval) {
+		ctx := context.Background()
+
+		expired, err := e.MessageDAO.GetExpiredMessages(ctx, time.Now().UnixNano(), reapBatch)
+		if err != nil {
+			log.Printf("Reaper error: %s", err)
+			continue
+		}
+
+		for _, msg := range expired {
+			_, err := e.MessageDAO.ExpireMessage(ctx, msg.ID)
+			if err == messages.ErrConflict {
+				// Deleted by its author or another instance meanwhile.
+				continue
+			}
+			if err != nil {
+				log.Printf("Reaper error: %s", err)
+				continue
+			}
+
+			e.messageTombstoned(ctx, msg, msg.From)
+
+			err = e.hub.PublishToChat(msg.ChatID, hub.EventMessageDeleted, &MessageDeletedPayload{
+				ID:           msg.ID,
+				ChatID:       msg.ChatID,
+				ThreadRootID: msg.ThreadRootID,
+				ForEveryone:  true,
+			})
+			if err != nil {
+				log.Printf("Websocket error: %s", err)
+			}
+		}
+	}
+}
+
+// closeDuePolls closes polls once their close time has passed and sends the
+// final results.
+func (e *Endpoints) closeDuePolls() {
+	for range time.Tick(schedulerInterval) {
+		ctx := context.Background()
+
+		due, err := e.MessageDAO.GetDuePolls(ctx, time.Now().UnixNano(), reapBatch)
+		if err != nil {
+			log.Printf("Poll error: %s", err)
+			continue
+		}
+
+		for _, msg := range due {
+			closed, err := e.MessageDAO.ClosePoll(ctx, msg.ID)
+			if err == messages.ErrPollClosed {
+				// Closed by its author or another instance meanwhile.
+				continue
+			}
+			if err != nil {
+				log.Printf("Poll error: %s", err)
+				continue
+			}
+
+			e.publishPoll(closed)
+		}
+	}
+}
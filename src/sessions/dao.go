@@ -0,0 +1,139 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx"
+)
+
+const (
+	DBName         = "messenger"
+	CollectionName = "sessions"
+)
+
+var ErrNotFound = errors.New("session not found")
+var ErrStaleToken = errors.New("refresh token was already rotated")
+
+type DAO struct {
+	client     *mongo.Client
+	db         *mongo.Database
+	collection *mongo.Collection
+}
+
+func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
+	db := client.Database(DBName)
+	collection := db.Collection(CollectionName)
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Options: options.Index().SetUnique(false),
+			Keys: bsonx.MDoc{
+				"userId": bsonx.Int32(1),
+			},
+		},
+		{
+			// Expired sessions are useless, let mongo clean them up.
+			Options: options.Index().SetExpireAfterSeconds(0),
+			Keys: bsonx.MDoc{
+				"expiresAt": bsonx.Int32(1),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DAO{
+		client:     client,
+		db:         db,
+		collection: collection,
+	}, nil
+}
+
+func (dao *DAO) AddSession(ctx context.Context, session *Session) error {
+	_, err := dao.collection.InsertOne(ctx, session)
+	return err
+}
+
+func (dao *DAO) GetSessionByID(ctx context.Context, id primitive.ObjectID) (*Session, error) {
+	filter := bson.D{{"_id", id}}
+
+	var session *Session
+	err := dao.collection.FindOne(ctx, filter).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// IsActive reports whether the session exists, is not revoked and has not
+// expired.
+func (dao *DAO) IsActive(ctx context.Context, id primitive.ObjectID) (bool, error) {
+	session, err := dao.GetSessionByID(ctx, id)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return session.Active(), nil
+}
+
+// Rotate swaps the session's refresh token hash from oldHash to newHash. It
+// fails with ErrStaleToken if another request rotated the token first.
+func (dao *DAO) Rotate(ctx context.Context, id primitive.ObjectID, oldHash, newHash []byte, expiresAt time.Time) error {
+	filter := bson.D{
+		{"_id", id},
+		{"refreshHash", oldHash},
+		{"revoked", false},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"refreshHash", newHash},
+		{"previousHash", oldHash},
+		{"refreshedAt", time.Now().UnixNano()},
+		{"expiresAt", expiresAt},
+	}}}
+
+	res, err := dao.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrStaleToken
+	}
+
+	return nil
+}
+
+func (dao *DAO) Revoke(ctx context.Context, id primitive.ObjectID) error {
+	filter := bson.D{{"_id", id}}
+	update := bson.D{{"$set", bson.D{{"revoked", true}}}}
+
+	_, err := dao.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// RevokeAllByUser logs the user out on every device.
+func (dao *DAO) RevokeAllByUser(ctx context.Context, userID primitive.ObjectID) error {
+	filter := bson.D{{"userId", userID}}
+	update := bson.D{{"$set", bson.D{{"revoked", true}}}}
+
+	_, err := dao.collection.UpdateMany(ctx, filter, update)
+	return err
+}
+
+func (dao *DAO) Drop(ctx context.Context) error {
+	return dao.collection.Drop(ctx)
+}
@@ -0,0 +1,26 @@
+package sessions
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Session is created on login and backs one chain of refresh tokens. Only
+// hashes of refresh tokens are stored; the previous hash is kept to detect a
+// refresh token being replayed after it was rotated.
+type Session struct {
+	ID           primitive.ObjectID `bson:"_id" json:"id"`
+	UserID       primitive.ObjectID `bson:"userId" json:"userId"`
+	RefreshHash  []byte             `bson:"refreshHash" json:"-"`
+	PreviousHash []byte             `bson:"previousHash,omitempty" json:"-"`
+	UserAgent    string             `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	CreatedAt    int64              `bson:"createdAt" json:"createdAt"`
+	RefreshedAt  int64              `bson:"refreshedAt,omitempty" json:"refreshedAt,omitempty"`
+	ExpiresAt    time.Time          `bson:"expiresAt" json:"expiresAt"`
+	Revoked      bool               `bson:"revoked" json:"revoked"`
+}
+
+func (s *Session) Active() bool {
+	return !s.Revoked && time.Now().Before(s.ExpiresAt)
+}
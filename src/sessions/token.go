@@ -0,0 +1,47 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrMalformedToken = errors.New("malformed refresh token")
+
+// NewRefreshToken returns an opaque refresh token for the session together
+// with the hash that has to be stored. The session ID is embedded so the
+// session can be found without indexing the secret.
+func NewRefreshToken(sessionID primitive.ObjectID) (string, []byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	token := sessionID.Hex() + "." + base64.RawURLEncoding.EncodeToString(secret)
+
+	return token, HashRefreshToken(token), nil
+}
+
+// ParseRefreshToken extracts the session ID and the hash of token.
+func ParseRefreshToken(token string) (primitive.ObjectID, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return primitive.ObjectID{}, nil, ErrMalformedToken
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil {
+		return primitive.ObjectID{}, nil, ErrMalformedToken
+	}
+
+	return sessionID, HashRefreshToken(token), nil
+}
+
+func HashRefreshToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
@@ -7,6 +7,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 const (
@@ -14,6 +15,7 @@ const (
 	CollectionName = "attachments"
 )
 
+var ErrNotFound = errors.New("attachment not found")
 
 type DAO struct {
 	client *mongo.Client
@@ -50,6 +52,10 @@ func (dao *DAO) GetAttachmentByID(ctx context.Context, id primitive.ObjectID) (*
 		items = append(items, item)
 	}
 
+	if len(items) == 0 {
+		return nil, ErrNotFound
+	}
+
 	if len(items) !=1 {
 		return nil, errors.New("len(items) !=1")
 	}
@@ -57,6 +63,23 @@ func (dao *DAO) GetAttachmentByID(ctx context.Context, id primitive.ObjectID) (*
 	return items[0], nil
 }
 
+// GetAttachmentInfo returns the attachment without its content.
+func (dao *DAO) GetAttachmentInfo(ctx context.Context, id primitive.ObjectID) (*Attachment, error) {
+	filter := bson.D{{"_id", id}}
+	opts := options.FindOne().SetProjection(bson.D{{"content", 0}})
+
+	var item *Attachment
+	err := dao.collection.FindOne(ctx, filter, opts).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return item, nil
+}
+
 func (dao *DAO) InsertAttachment(ctx context.Context, data *Attachment) error{
 	if _, err:= dao.collection.InsertOne(ctx, data); err!=nil {
 		return err
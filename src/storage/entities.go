@@ -4,5 +4,6 @@ import "go.mongodb.org/mongo-driver/bson/primitive"
 
 type Attachment struct {
 	ID primitive.ObjectID `bson:"_id" json:"id"`
-	Content []byte `bson:"content" json:"content"`
+	Owner primitive.ObjectID `bson:"owner,omitempty" json:"owner,omitempty"`
+	Content []byte `bson:"content,omitempty" json:"content,omitempty"`
 }
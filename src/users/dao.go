@@ -3,6 +3,7 @@ package users
 import (
 	"context"
 	"errors"
+	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -14,13 +15,25 @@ import (
 const (
 	DBName = "messenger"
 	CollectionName = "users"
+	PresenceCollectionName = "instancePresence"
 )
 
+// instancePresenceTTL removes the presence left behind by instances that
+// went away without cleaning up.
+const instancePresenceTTL = 60 * 60
+
+var ErrNotFound = errors.New("user not found")
+
+// ErrInvalidCredentials is returned for both unknown nicknames and wrong
+// passwords so that callers cannot tell them apart.
+var ErrInvalidCredentials = errors.New("invalid credentials")
 
 type DAO struct {
 	client *mongo.Client
 	db *mongo.Database
 	collection *mongo.Collection
+	presence *mongo.Collection
+	passwords *Passwords
 }
 
 func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
@@ -42,13 +55,102 @@ func NewDAO(ctx context.Context, client *mongo.Client) (*DAO, error) {
 		return nil, err
 	}
 
+	presence := db.Collection(PresenceCollectionName)
+	_, err = presence.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Options: options.Index().SetUnique(true),
+			Keys: bsonx.Doc{
+				{"userId", bsonx.Int32(1)},
+				{"instanceId", bsonx.Int32(1)},
+			},
+		},
+		{
+			Options: options.Index().SetExpireAfterSeconds(instancePresenceTTL),
+			Keys: bsonx.MDoc{
+				"seenAt": bsonx.Int32(1),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &DAO{
 		client:client,
 		db:db,
 		collection:collection,
+		presence: presence,
+		passwords: NewPasswords(NewArgon2idHasher(), NewBcryptHasher()),
 	}, nil
 }
 
+// SetPasswords replaces the hashers used for new and existing passwords.
+func (dao *DAO) SetPasswords(passwords *Passwords) {
+	dao.passwords = passwords
+}
+
+// SetPassword hashes password into user without saving it.
+func (dao *DAO) SetPassword(user *User, password string) error {
+	return dao.passwords.SetPassword(user, password)
+}
+
+// Authenticate returns the user with the given nickname if password matches.
+func (dao *DAO) Authenticate(ctx context.Context, nickname, password string) (*User, error) {
+	user, err := dao.GetUserByNickname(ctx, nickname)
+	if err == ErrNotFound {
+		dao.passwords.CheckDummyPassword(password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := dao.VerifyPassword(ctx, user, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// VerifyPassword checks password against the user's stored hash and, on
+// success, upgrades legacy or outdated hashes in place.
+func (dao *DAO) VerifyPassword(ctx context.Context, user *User, password string) (bool, error) {
+	ok, needsRehash, err := dao.passwords.CheckPassword(user, password)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	if !needsRehash {
+		return true, nil
+	}
+
+	if err := dao.passwords.SetPassword(user, password); err != nil {
+		return false, err
+	}
+
+	if err := dao.UpdatePassword(ctx, user); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (dao *DAO) UpdatePassword(ctx context.Context, user *User) error {
+	filter := bson.D{{"_id", user.ID}}
+	update := bson.D{{"$set", bson.D{
+		{"password", user.Password},
+		{"passwordAlgorithm", user.PasswordAlgorithm},
+	}}}
+
+	_, err := dao.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
 func (dao *DAO) GetUserByID(ctx context.Context, userID primitive.ObjectID) (*User, error) {
 	filter := bson.D{{"_id", userID}}
 
@@ -67,6 +169,10 @@ func (dao *DAO) GetUserByID(ctx context.Context, userID primitive.ObjectID) (*Us
 		users = append(users, user)
 	}
 
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+
 	if len(users) !=1 {
 		return nil, errors.New("len(users) !=1")
 	}
@@ -92,6 +198,10 @@ func (dao *DAO) GetUserByNickname(ctx context.Context, nickname string) (*User,
 		users = append(users, user)
 	}
 
+	if len(users) == 0 {
+		return nil, ErrNotFound
+	}
+
 	if len(users) !=1 {
 		return nil, errors.New("len(users) !=1")
 	}
@@ -99,6 +209,94 @@ func (dao *DAO) GetUserByNickname(ctx context.Context, nickname string) (*User,
 	return users[0], nil
 }
 
+func (dao *DAO) GetUsersByIDs(ctx context.Context, ids []primitive.ObjectID) ([]*User, error) {
+	filter := bson.D{{"_id", bson.D{{"$in", ids}}}}
+
+	cursor, err := dao.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// GetUsersByNicknames returns the users with the given nicknames, unknown
+// ones are left out.
+func (dao *DAO) GetUsersByNicknames(ctx context.Context, nicknames []string) ([]*User, error) {
+	filter := bson.D{{"nickName", bson.D{{"$in", nicknames}}}}
+
+	cursor, err := dao.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*User
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SetPresence stores the user's presence and the time it was seen.
+func (dao *DAO) SetPresence(ctx context.Context, userID primitive.ObjectID, presence string, lastSeen int64) error {
+	filter := bson.D{{"_id", userID}}
+	update := bson.D{{"$set", bson.D{
+		{"presence", presence},
+		{"lastSeen", lastSeen},
+	}}}
+
+	_, err := dao.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// SetInstancePresence stores the user's presence on one instance.
+func (dao *DAO) SetInstancePresence(ctx context.Context, userID primitive.ObjectID, instanceID, state string, seenAt time.Time) error {
+	filter := bson.D{{"userId", userID}, {"instanceId", instanceID}}
+	update := bson.D{{"$set", bson.D{
+		{"state", state},
+		{"seenAt", seenAt},
+	}}}
+
+	_, err := dao.presence.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// RemoveInstancePresence forgets the user on an instance they are no longer
+// connected to.
+func (dao *DAO) RemoveInstancePresence(ctx context.Context, userID primitive.ObjectID, instanceID string) error {
+	filter := bson.D{{"userId", userID}, {"instanceId", instanceID}}
+
+	_, err := dao.presence.DeleteOne(ctx, filter)
+	return err
+}
+
+// GetInstancePresence returns the user's presence on every instance that
+// reported it since the given time.
+func (dao *DAO) GetInstancePresence(ctx context.Context, userID primitive.ObjectID, since time.Time) ([]*InstancePresence, error) {
+	filter := bson.D{
+		{"userId", userID},
+		{"seenAt", bson.D{{"$gt", since}}},
+	}
+
+	cursor, err := dao.presence.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*InstancePresence
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func (dao *DAO) InsertUser(ctx context.Context, user *User) error {
 	_,err:= dao.collection.InsertOne(ctx, user)
 	return err
@@ -1,6 +1,8 @@
 package users
 
 import (
+	"time"
+
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
@@ -10,4 +12,20 @@ type User struct {
 	SecondName string `bson:"secondName" json:"secondName"`
 	NickName string `bson:"nickName" json:"nickName"`
 	Password string `bson:"password" json:"-"`
+	PasswordAlgorithm string `bson:"passwordAlgorithm,omitempty" json:"-"`
+	// Presence is the last state combined from the servers the user was
+	// connected to, LastSeen when it was stored. A presence that was not
+	// refreshed for a while is stale and the user is offline.
+	Presence string `bson:"presence,omitempty" json:"-"`
+	LastSeen int64 `bson:"lastSeen,omitempty" json:"-"`
+}
+
+// InstancePresence is the presence of a user on one server instance, kept
+// fresh by the instance's heartbeat. The presence of the user combines the
+// fresh ones of every instance.
+type InstancePresence struct {
+	UserID primitive.ObjectID `bson:"userId"`
+	InstanceID string `bson:"instanceId"`
+	State string `bson:"state"`
+	SeenAt time.Time `bson:"seenAt"`
 }
@@ -0,0 +1,249 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// AlgorithmPlaintext marks legacy records that were stored before hashing
+	// was introduced. They are accepted once and rehashed on the next login.
+	AlgorithmPlaintext = ""
+	AlgorithmArgon2id  = "argon2id"
+	AlgorithmBcrypt    = "bcrypt"
+)
+
+var ErrUnknownAlgorithm = errors.New("unknown password algorithm")
+var errMalformedHash = errors.New("malformed password hash")
+
+// Hasher hashes and verifies passwords with a single algorithm. The encoded
+// hash returned by Hash carries its own parameters so that they can be
+// changed without invalidating existing records.
+type Hasher interface {
+	Algorithm() string
+	Hash(password string) (string, error)
+	Verify(encoded, password string) (bool, error)
+	NeedsRehash(encoded string) bool
+}
+
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+func NewArgon2idHasher() *Argon2idHasher {
+	return &Argon2idHasher{
+		Time:    1,
+		Memory:  64 * 1024,
+		Threads: 4,
+		SaltLen: 16,
+		KeyLen:  32,
+	}
+}
+
+func (h *Argon2idHasher) Algorithm() string {
+	return AlgorithmArgon2id
+}
+
+func (h *Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2idHasher) Verify(encoded, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h *Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Time != h.Time ||
+		params.Memory != h.Memory ||
+		params.Threads != h.Threads ||
+		uint32(len(salt)) != h.SaltLen ||
+		uint32(len(key)) != h.KeyLen
+}
+
+func decodeArgon2id(encoded string) (*Argon2idHasher, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return nil, nil, nil, errMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, nil, nil, errMalformedHash
+	}
+	if version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2 version %d", version)
+	}
+
+	params := &Argon2idHasher{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return nil, nil, nil, errMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, errMalformedHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, errMalformedHash
+	}
+
+	return params, salt, key, nil
+}
+
+type BcryptHasher struct {
+	Cost int
+}
+
+func NewBcryptHasher() *BcryptHasher {
+	return &BcryptHasher{Cost: bcrypt.DefaultCost}
+}
+
+func (h *BcryptHasher) Algorithm() string {
+	return AlgorithmBcrypt
+}
+
+func (h *BcryptHasher) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (h *BcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (h *BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+
+	return cost != h.Cost
+}
+
+// Passwords hashes new passwords with the current hasher and verifies stored
+// ones with whichever registered hasher produced them.
+type Passwords struct {
+	current Hasher
+	hashers map[string]Hasher
+
+	dummyOnce sync.Once
+	dummy     *User
+}
+
+func NewPasswords(current Hasher, others ...Hasher) *Passwords {
+	p := &Passwords{
+		current: current,
+		hashers: map[string]Hasher{current.Algorithm(): current},
+	}
+
+	for _, h := range others {
+		if _, ok := p.hashers[h.Algorithm()]; !ok {
+			p.hashers[h.Algorithm()] = h
+		}
+	}
+
+	return p
+}
+
+// SetPassword replaces the user's password with a hash made by the current
+// hasher. It does not persist the user.
+func (p *Passwords) SetPassword(user *User, password string) error {
+	hash, err := p.current.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+	user.PasswordAlgorithm = p.current.Algorithm()
+
+	return nil
+}
+
+// CheckPassword verifies password against the user's stored credentials.
+// needsRehash is set when the password matched but the record is plaintext,
+// was made by another algorithm or with outdated parameters.
+func (p *Passwords) CheckPassword(user *User, password string) (ok bool, needsRehash bool, err error) {
+	if user.PasswordAlgorithm == AlgorithmPlaintext {
+		ok = subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+		return ok, ok, nil
+	}
+
+	hasher, found := p.hashers[user.PasswordAlgorithm]
+	if !found {
+		return false, false, ErrUnknownAlgorithm
+	}
+
+	ok, err = hasher.Verify(user.Password, password)
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	needsRehash = hasher != p.current || hasher.NeedsRehash(user.Password)
+
+	return true, needsRehash, nil
+}
+
+// CheckDummyPassword spends as much time as checking a real password. It is
+// used when the user does not exist so that response times do not reveal
+// which nicknames are registered.
+func (p *Passwords) CheckDummyPassword(password string) {
+	p.dummyOnce.Do(func() {
+		p.dummy = &User{}
+		if err := p.SetPassword(p.dummy, "dummy password"); err != nil {
+			p.dummy = nil
+		}
+	})
+
+	if p.dummy != nil {
+		p.CheckPassword(p.dummy, password)
+	}
+}